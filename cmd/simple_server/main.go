@@ -1,59 +1,231 @@
 package main
 
 import (
+	"context"
 	"dns/internal/parser"
 	"dns/internal/resolver"
+	"dns/internal/server"
+	"dns/internal/zone"
 	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
 	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"go.uber.org/zap"
 )
 
 func main() {
+	workers := flag.Int("workers", 64, "number of goroutines resolving UDP queries")
+	queueDepth := flag.Int("queue", 1024, "number of UDP queries waiting for a worker before new ones are refused")
+	timeout := flag.Duration("timeout", resolver.DefaultConfig().Timeout, "deadline for each query sent to a nameserver")
+	retries := flag.Int("retries", resolver.DefaultConfig().Retries, "times a nameserver that timed out is retried before failing over")
+	cacheEntries := flag.Int("cache-entries", resolver.DefaultCacheConfig().MaxEntries, "maximum number of RRsets held in the cache, 0 for no limit")
+	cacheBytes := flag.Int("cache-bytes", resolver.DefaultCacheConfig().MaxBytes, "approximate maximum memory used by the cache in bytes, 0 for no limit")
+	prefetchHits := flag.Int("prefetch-hits", resolver.DefaultCacheConfig().PrefetchHits, "hits after which a cached RRset is refreshed before it expires, 0 to disable")
+	prefetchFraction := flag.Float64("prefetch-fraction", resolver.DefaultCacheConfig().PrefetchFraction, "fraction of its TTL an RRset must have left before it is prefetched")
+	staleWindow := flag.Duration("serve-stale", resolver.DefaultCacheConfig().StaleWindow, "how long expired records are kept to answer with when resolution fails, 0 to disable")
+	minTTL := flag.Uint("min-ttl", uint(resolver.DefaultCacheConfig().MinTTL), "lowest TTL in seconds records are cached for, 0 for no minimum")
+	maxTTL := flag.Uint("max-ttl", uint(resolver.DefaultCacheConfig().MaxTTL), "highest TTL in seconds records are cached for, 0 for no maximum")
+	cacheFile := flag.String("cache-file", "", "file the cache is saved to on shutdown and loaded from on startup")
+	snapshotInterval := flag.Duration("snapshot-interval", 5*time.Minute, "how often the cache is saved to -cache-file, 0 to only save on shutdown")
+	rootHints := flag.String("root-hints", "", "named.root style file listing the root servers, built-in hints are used when empty")
+	primeInterval := flag.Duration("prime-interval", resolver.DefaultConfig().PrimeInterval, "how often the root servers are refreshed with a priming query, 0 to disable")
+	forwarders := flag.String("forward", "", "comma separated upstream resolvers to forward every query to instead of resolving from the root")
+	rules := make([]resolver.Rule, 0)
+	flag.Func("forward-zone", "zone=ip,... forwarding queries for names in the zone to the given resolvers, may be repeated", func(v string) error {
+		return addRule(&rules, resolver.ForwardRule, v)
+	})
+	flag.Func("stub-zone", "zone=ip,... resolving names in the zone starting at the given authoritative servers, may be repeated", func(v string) error {
+		return addRule(&rules, resolver.StubRule, v)
+	})
+	zones := make([]*zone.Zone, 0)
+	flag.Func("zone", "[origin=]file of a master file to answer authoritatively from, may be repeated", func(v string) error {
+		origin, path, ok := strings.Cut(v, "=")
+		if !ok {
+			origin, path = "", v
+		}
+		z, err := zone.Load(path, origin)
+		if err != nil {
+			return err
+		}
+		zones = append(zones, z)
+		return nil
+	})
+	hostsFiles := make([]string, 0)
+	flag.Func("hosts", "file in /etc/hosts format whose names are answered locally, may be repeated", func(v string) error {
+		hostsFiles = append(hostsFiles, v)
+		return nil
+	})
+	overrideFiles := make([]string, 0)
+	flag.Func("overrides", "file of \"name [ttl] A|AAAA ip\" and \"name NXDOMAIN\" lines answered locally, may be repeated", func(v string) error {
+		overrideFiles = append(overrideFiles, v)
+		return nil
+	})
+	localTTL := flag.Uint("local-ttl", 300, "TTL in seconds of answers from -hosts and -overrides entries without their own")
+	flag.Parse()
+
 	logger, _ := zap.NewDevelopment()
 	defer logger.Sync()
 	addr, _ := net.ResolveUDPAddr("udp", ":53")
-	conn, _ := net.ListenUDP("udp", addr)
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
 	defer conn.Close()
+	tcpAddr, _ := net.ResolveTCPAddr("tcp", ":53")
+	ln, err := net.ListenTCP("tcp", tcpAddr)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	defer ln.Close()
 
-	r := resolver.NewResolver(logger)
-	logger.Info("Listening on :53")
-	buf := make([]byte, 512)
-	for {
-		n, clientAddr, _ := conn.ReadFromUDP(buf)
-		logger.Info("New connection", zap.String("IP", clientAddr.String()))
-		m, err := parser.ParseDNSMessage(buf[:n], parser.Query)
-		logger.Debug("Incoming Query", zap.String("Message", m.String()))
-		if err != nil {
-			logger.Error(err.Error())
-			r := getErrorResponse(err)
-			if r != nil {
-				conn.WriteToUDP(r, clientAddr)
+	config := resolver.DefaultConfig()
+	config.Timeout = *timeout
+	config.Retries = *retries
+	config.Cache.MaxEntries = *cacheEntries
+	config.Cache.MaxBytes = *cacheBytes
+	config.Cache.PrefetchHits = *prefetchHits
+	config.Cache.PrefetchFraction = *prefetchFraction
+	config.Cache.StaleWindow = *staleWindow
+	config.Cache.MinTTL = uint32(*minTTL)
+	config.Cache.MaxTTL = uint32(*maxTTL)
+	config.RootHints = *rootHints
+	config.PrimeInterval = *primeInterval
+	config.Rules = rules
+	config.Zones = zones
+	if len(hostsFiles) > 0 || len(overrideFiles) > 0 {
+		config.LocalData = resolver.NewLocalData(uint32(*localTTL))
+		for _, path := range hostsFiles {
+			if err := config.LocalData.LoadHosts(path); err != nil {
+				logger.Fatal(err.Error())
 			}
-			continue
 		}
-		ans, err := r.ResolveQuery(m)
-		logger.Debug("Response to client", zap.String("Message", ans.String()))
-		if err != nil {
-			logger.Error(err.Error())
-			r := getErrorResponse(err)
-			if r != nil {
-				conn.WriteToUDP(r, clientAddr)
+		for _, path := range overrideFiles {
+			if err := config.LocalData.LoadOverrides(path); err != nil {
+				logger.Fatal(err.Error())
 			}
-			continue
 		}
-		resp := parser.SerializeDNSMessage(ans)
-		_, err = conn.WriteToUDP(resp, clientAddr)
+	}
+	if *forwarders != "" {
+		config.Forwarders, err = parseAddresses(*forwarders)
 		if err != nil {
-			logger.Error(err.Error())
+			logger.Fatal(err.Error())
+		}
+	}
+	r := resolver.NewResolver(logger, config)
+	defer r.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *cacheFile != "" {
+		loadCache(&r, *cacheFile, logger)
+		if *snapshotInterval > 0 {
+			go saveCachePeriodically(ctx, &r, *cacheFile, *snapshotInterval, logger)
+		}
+	}
+	go func() {
+		<-ctx.Done()
+		logger.Info("Shutting down")
+		conn.Close()
+		ln.Close()
+	}()
+
+	go serveTCP(ln, &r, logger)
+	logger.Info("Listening on :53")
+	newUDPServer(conn, &r, logger, *workers, *queueDepth).serve()
+
+	if *cacheFile != "" {
+		saveCache(&r, *cacheFile, logger)
+	}
+}
+
+func parseAddresses(list string) ([]net.IP, error) {
+	ips := make([]net.IP, 0)
+	for _, addr := range strings.Split(list, ",") {
+		ip := net.ParseIP(strings.TrimSpace(addr))
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid address %q", addr)
 		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+func addRule(rules *[]resolver.Rule, ruleType resolver.RuleType, v string) error {
+	zone, servers, ok := strings.Cut(v, "=")
+	if !ok || zone == "" {
+		return errors.New("Expected zone=ip,...")
+	}
+	ips, err := parseAddresses(servers)
+	if err != nil {
+		return err
+	}
+	*rules = append(*rules, resolver.Rule{Zone: zone, Type: ruleType, Servers: ips})
+	return nil
+}
+
+func loadCache(r *resolver.Resolver, path string, logger *zap.Logger) {
+	n, err := r.LoadCache(path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			logger.Error("Could not load cache", zap.String("File", path), zap.Error(err))
+		}
+		return
+	}
+	logger.Info("Loaded cache", zap.String("File", path), zap.Int("Entries", n))
+}
+
+func saveCache(r *resolver.Resolver, path string, logger *zap.Logger) {
+	if err := r.SaveCache(path); err != nil {
+		logger.Error("Could not save cache", zap.String("File", path), zap.Error(err))
+		return
+	}
+	logger.Debug("Saved cache", zap.String("File", path))
+}
+
+func saveCachePeriodically(ctx context.Context, r *resolver.Resolver, path string, interval time.Duration, logger *zap.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			saveCache(r, path, logger)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func handleQuery(data []byte, r *resolver.Resolver, logger *zap.Logger, protocol server.Protocol) []byte {
+	m, err := parser.ParseDNSMessage(data, parser.Query)
+	if err != nil {
+		logger.Error(err.Error())
+		return getErrorResponse(err, nil)
+	}
+	logger.Debug("Incoming Query", zap.String("Message", m.String()))
+	ans, err := r.ResolveQuery(m)
+	if err != nil {
+		logger.Error(err.Error())
+		return getErrorResponse(err, m.Questions)
+	}
+	logger.Debug("Response to client", zap.String("Message", ans.String()))
+	maxSize := parser.MaxTCPSize
+	if protocol == server.UDP {
+		maxSize = m.GetUDPSize()
 	}
+	return parser.SerializeTruncatedDNSMessage(ans, maxSize)
 }
 
-func getErrorResponse(err error) []byte {
+func getErrorResponse(err error, questions []parser.DNSQuestion) []byte {
 	var ce parser.CustomError
 	if errors.As(err, &ce) {
-		return parser.SerializeDNSMessage(parser.CreateErrorResponseMessage(ce))
+		return parser.SerializeDNSMessage(parser.CreateErrorResponseMessage(ce, questions))
 	}
 	return nil
 }
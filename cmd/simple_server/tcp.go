@@ -0,0 +1,65 @@
+package main
+
+import (
+	"dns/internal/resolver"
+	"dns/internal/server"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const tcpIdleTimeout = 10 * time.Second
+
+func serveTCP(ln *net.TCPListener, r *resolver.Resolver, logger *zap.Logger) {
+	logger.Info("Listening on TCP :53")
+	for {
+		conn, err := ln.AcceptTCP()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Error(err.Error())
+			continue
+		}
+		go handleTCPConn(conn, r, logger)
+	}
+}
+
+func handleTCPConn(conn *net.TCPConn, r *resolver.Resolver, logger *zap.Logger) {
+	defer conn.Close()
+	logger.Info("New TCP connection", zap.String("IP", conn.RemoteAddr().String()))
+
+	// Queries on one connection may be pipelined, so each is resolved in its
+	// own goroutine and responses are written back as they complete.
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	defer wg.Wait()
+	for {
+		conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		data, err := server.ReadTCPMessage(conn)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				logger.Debug("Closing TCP connection", zap.String("IP", conn.RemoteAddr().String()), zap.Error(err))
+			}
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp := handleQuery(data, r, logger, server.TCP)
+			if resp == nil {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			conn.SetWriteDeadline(time.Now().Add(tcpIdleTimeout))
+			if err := server.WriteTCPMessage(conn, resp); err != nil {
+				logger.Error(err.Error())
+			}
+		}()
+	}
+}
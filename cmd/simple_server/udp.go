@@ -0,0 +1,101 @@
+package main
+
+import (
+	"dns/internal/parser"
+	"dns/internal/resolver"
+	"dns/internal/server"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// udpBufferSize is large enough for any query a client sends under EDNS.
+const udpBufferSize = 4096
+
+type udpRequest struct {
+	buf  *[]byte
+	n    int
+	addr *net.UDPAddr
+}
+
+type udpServer struct {
+	conn     *net.UDPConn
+	resolver *resolver.Resolver
+	logger   *zap.Logger
+	workers  int
+	queue    chan udpRequest
+	bufPool  sync.Pool
+}
+
+func (s *udpServer) serve() {
+	for i := 0; i < s.workers; i++ {
+		go s.work()
+	}
+	for {
+		buf := s.bufPool.Get().(*[]byte)
+		n, clientAddr, err := s.conn.ReadFromUDP(*buf)
+		if err != nil {
+			s.bufPool.Put(buf)
+			if errors.Is(err, net.ErrClosed) {
+				close(s.queue)
+				return
+			}
+			s.logger.Error(err.Error())
+			continue
+		}
+		s.logger.Info("New connection", zap.String("IP", clientAddr.String()))
+		req := udpRequest{buf: buf, n: n, addr: clientAddr}
+		select {
+		case s.queue <- req:
+		default:
+			s.shed(req)
+		}
+	}
+}
+
+func (s *udpServer) work() {
+	for req := range s.queue {
+		resp := handleQuery((*req.buf)[:req.n], s.resolver, s.logger, server.UDP)
+		s.bufPool.Put(req.buf)
+		if resp == nil {
+			continue
+		}
+		_, err := s.conn.WriteToUDP(resp, req.addr)
+		if err != nil {
+			s.logger.Error(err.Error())
+		}
+	}
+}
+
+func (s *udpServer) shed(req udpRequest) {
+	defer s.bufPool.Put(req.buf)
+	s.logger.Warn("Query queue full, refusing query", zap.String("IP", req.addr.String()))
+	if req.n < 2 {
+		return
+	}
+	id := binary.BigEndian.Uint16((*req.buf)[:2])
+	resp := getErrorResponse(parser.RefusedError{Err: errors.New("Server overloaded"), ID: id}, nil)
+	_, err := s.conn.WriteToUDP(resp, req.addr)
+	if err != nil {
+		s.logger.Error(err.Error())
+	}
+}
+
+func newUDPServer(conn *net.UDPConn, r *resolver.Resolver, logger *zap.Logger, workers int, queueDepth int) *udpServer {
+	return &udpServer{
+		conn:     conn,
+		resolver: r,
+		logger:   logger,
+		workers:  workers,
+		queue:    make(chan udpRequest, queueDepth),
+		bufPool: sync.Pool{
+			New: func() any {
+				buf := make([]byte, udpBufferSize)
+				return &buf
+			},
+		},
+	}
+}
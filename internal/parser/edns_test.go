@@ -0,0 +1,225 @@
+package parser
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseDNSMessageQuery_EDNS(t *testing.T) {
+	tests := []struct {
+		name          string
+		query         []byte
+		expectError   bool
+		expectBadVers bool
+		expectUDPSize uint16
+		expectDO      bool
+		expectOptions int
+	}{
+		{
+			name: "OPT record with cookie option",
+			query: []byte{
+				0x12, 0x34, 0x01, 0x00,
+				0x00, 0x01, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x01, // ARCOUNT=1
+				0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00,
+				0x00, 0x01, 0x00, 0x01,
+				0x00,       // root
+				0x00, 0x29, // Type OPT
+				0x10, 0x00, // UDP size 4096
+				0x00, 0x00, 0x80, 0x00, // DO bit
+				0x00, 0x0c, // RDLENGTH
+				0x00, 0x0a, 0x00, 0x08, 1, 2, 3, 4, 5, 6, 7, 8,
+			},
+			expectUDPSize: 4096,
+			expectDO:      true,
+			expectOptions: 1,
+		},
+		{
+			name: "OPT record without options",
+			query: []byte{
+				0x12, 0x34, 0x01, 0x00,
+				0x00, 0x01, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x01,
+				0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00,
+				0x00, 0x01, 0x00, 0x01,
+				0x00, 0x00, 0x29, 0x04, 0xd0,
+				0x00, 0x00, 0x00, 0x00,
+				0x00, 0x00,
+			},
+			expectUDPSize: 1232,
+		},
+		{
+			name: "unsupported EDNS version",
+			query: []byte{
+				0x12, 0x34, 0x01, 0x00,
+				0x00, 0x01, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x01,
+				0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00,
+				0x00, 0x01, 0x00, 0x01,
+				0x00, 0x00, 0x29, 0x04, 0xd0,
+				0x00, 0x01, 0x00, 0x00, // version 1
+				0x00, 0x00,
+			},
+			expectError:   true,
+			expectBadVers: true,
+		},
+		{
+			name: "multiple OPT records",
+			query: []byte{
+				0x12, 0x34, 0x01, 0x00,
+				0x00, 0x01, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x02,
+				0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00,
+				0x00, 0x01, 0x00, 0x01,
+				0x00, 0x00, 0x29, 0x04, 0xd0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+				0x00, 0x00, 0x29, 0x04, 0xd0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			},
+			expectError: true,
+		},
+		{
+			name: "truncated option",
+			query: []byte{
+				0x12, 0x34, 0x01, 0x00,
+				0x00, 0x01, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x01,
+				0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00,
+				0x00, 0x01, 0x00, 0x01,
+				0x00, 0x00, 0x29, 0x04, 0xd0,
+				0x00, 0x00, 0x00, 0x00,
+				0x00, 0x06,
+				0x00, 0x0a, 0x00, 0x08, 1, 2,
+			},
+			expectError: true,
+		},
+		{
+			name: "option overruns RDLENGTH",
+			query: []byte{
+				0x12, 0x34, 0x01, 0x00,
+				0x00, 0x01, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x01,
+				0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00,
+				0x00, 0x01, 0x00, 0x01,
+				0x00, 0x00, 0x29, 0x04, 0xd0,
+				0x00, 0x00, 0x00, 0x00,
+				0x00, 0x06, // RDLENGTH shorter than the option
+				0x00, 0x0a, 0x00, 0x08, 1, 2, 3, 4, 5, 6, 7, 8,
+			},
+			expectError: true,
+		},
+		{
+			name: "trailing bytes after options",
+			query: []byte{
+				0x12, 0x34, 0x01, 0x00,
+				0x00, 0x01, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x01,
+				0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00,
+				0x00, 0x01, 0x00, 0x01,
+				0x00, 0x00, 0x29, 0x04, 0xd0,
+				0x00, 0x00, 0x00, 0x00,
+				0x00, 0x06,
+				0x00, 0x0a, 0x00, 0x00, 0xff, 0xff,
+			},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := ParseDNSMessage(tt.query, Query)
+			if tt.expectError {
+				if err == nil {
+					t.Fatalf("expected error, got none")
+				}
+				if _, ok := err.(BadVersError); ok != tt.expectBadVers {
+					t.Errorf("expected BADVERS %v, got %v", tt.expectBadVers, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			e, ok := msg.GetEDNS()
+			if !ok {
+				t.Fatal("expected EDNS to be present")
+			}
+			if e.UDPSize != tt.expectUDPSize {
+				t.Errorf("expected UDP size %d, got %d", tt.expectUDPSize, e.UDPSize)
+			}
+			if e.DO != tt.expectDO {
+				t.Errorf("expected DO %v, got %v", tt.expectDO, e.DO)
+			}
+			if len(e.Options) != tt.expectOptions {
+				t.Errorf("expected %d options, got %d", tt.expectOptions, len(e.Options))
+			}
+		})
+	}
+}
+
+func TestCreateEDNSQuery_RoundTrip(t *testing.T) {
+	query := CreateEDNSQuery("example.com.", RTA, RCIN, EDNSUDPSize)
+	msg, err := ParseDNSMessage(query, Query)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	e, ok := msg.GetEDNS()
+	if !ok {
+		t.Fatal("expected EDNS to be present")
+	}
+	if e.UDPSize != EDNSUDPSize || e.Version != 0 || e.DO {
+		t.Errorf("unexpected EDNS %v", e)
+	}
+}
+
+func TestCreateResponseMessage_EchoesEDNS(t *testing.T) {
+	q := createQueryMessage("example.com.", RTA, RCIN)
+	q.addEDNS(EDNS{UDPSize: 4096, DO: true})
+
+	msg := CreateResponseMessage(q, NXDomain, nil, nil)
+	e, ok := msg.GetEDNS()
+	if !ok {
+		t.Fatal("expected response to carry EDNS")
+	}
+	if e.UDPSize != EDNSUDPSize || !e.DO {
+		t.Errorf("unexpected EDNS %v", e)
+	}
+	if msg.GetRCode() != NXDomain {
+		t.Errorf("expected NXDOMAIN, got %v", msg.GetRCode())
+	}
+
+	plain := CreateResponseMessage(createQueryMessage("example.com.", RTA, RCIN), NoError, nil, nil)
+	if _, ok := plain.GetEDNS(); ok {
+		t.Error("expected no EDNS in response to plain query")
+	}
+}
+
+func TestCreateErrorResponseMessage_BadVers(t *testing.T) {
+	msg := CreateErrorResponseMessage(BadVersError{ID: 0x1234}, nil)
+	wire := SerializeDNSMessage(msg)
+	parsed, err := ParseDNSMessage(wire, Response)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if parsed.Header.GetRCode() != NoError {
+		t.Errorf("expected lower RCODE bits to be zero, got %v", parsed.Header.GetRCode())
+	}
+	if parsed.GetRCode() != BadVers {
+		t.Errorf("expected BADVERS, got %v", parsed.GetRCode())
+	}
+}
+
+func TestSerializeOPTRecord(t *testing.T) {
+	rr := CreateOPTRecord(EDNS{UDPSize: 1232, Options: []EDNSOption{{Code: 10, Data: []byte{1, 2}}}})
+	s := dnsWriter{names: make(map[string]int)}
+	s.serializeDNSResourceRecord([]DNSResourceRecord{rr})
+	expected := []byte{
+		0x00,
+		0x00, 0x29,
+		0x04, 0xd0,
+		0x00, 0x00, 0x00, 0x00,
+		0x00, 0x06,
+		0x00, 0x0a, 0x00, 0x02, 1, 2,
+	}
+	if !bytes.Equal(s.data, expected) {
+		t.Errorf("byte mismatch:\ngot  %v\nwant %v", s.data, expected)
+	}
+}
@@ -192,9 +192,6 @@ func (h *DNSHeader) validateHeader(mode MessageType) error {
 		if h.NSCount > 0 {
 			return errors.New("NSCOUNT set in query")
 		}
-		if h.ARCount > 0 {
-			return errors.New("ARCOUNT set in query")
-		}
 		if h.GetOpcode() > OCSTATUS {
 			return NotImpError{fmt.Errorf("Unsupported OPCODE %s", h.GetOpcode()), h.ID}
 		}
@@ -428,6 +425,40 @@ func (r *dnsReader) parseAAAARecord() (AAAARecord, error) {
 	return res, nil
 }
 
+func (r *dnsReader) parseOPTRecord(length int) (OPTRecord, error) {
+	res := OPTRecord{}
+	endPos := r.pos + length
+	for r.pos < endPos {
+		if endPos-r.pos < 4 {
+			return OPTRecord{}, errors.New("Trailing bytes after EDNS options")
+		}
+		o := EDNSOption{}
+		var err error
+		o.Code, err = r.readUint16()
+		if err != nil {
+			return OPTRecord{}, err
+		}
+		optLength, err := r.readUint16()
+		if err != nil {
+			return OPTRecord{}, err
+		}
+		if r.pos+int(optLength) > endPos {
+			return OPTRecord{}, fmt.Errorf("EDNS option %d overruns RDLENGTH", o.Code)
+		}
+		if optLength > 0 {
+			o.Data, err = r.readBytes(int(optLength))
+			if err != nil {
+				return OPTRecord{}, err
+			}
+		}
+		res.Options = append(res.Options, o)
+	}
+	if r.pos != endPos {
+		return OPTRecord{}, errors.New("EDNS options not aligned with RDLENGTH")
+	}
+	return res, nil
+}
+
 func (r *dnsReader) parseRData(rt RecordType, rc RecordClass, length int) (RData, error) {
 	var res RData
 	var err error
@@ -467,6 +498,8 @@ func (r *dnsReader) parseRData(rt RecordType, rc RecordClass, length int) (RData
 		res, err = r.parseTXTRecord(length)
 	case RTAAAA:
 		res, err = r.parseAAAARecord()
+	case RTOPT:
+		res, err = r.parseOPTRecord(length)
 	default:
 		return nil, NotImpError{fmt.Errorf("Unsupported record type %v", rt), r.id}
 	}
@@ -582,6 +615,59 @@ func (r *dnsReader) parseDNSQuestion(qdCount uint16) ([]DNSQuestion, error) {
 	return questions, nil
 }
 
+func (m DNSMessage) GetEDNS() (EDNS, bool) {
+	for _, rr := range m.Additionals {
+		if rr.Type != RTOPT {
+			continue
+		}
+		e := EDNS{
+			UDPSize:       uint16(rr.Class),
+			ExtendedRCode: uint8((rr.TTL & ExtendedRCodeMask) >> 24),
+			Version:       uint8((rr.TTL & VersionMask) >> 16),
+			DO:            rr.TTL&DOMask != 0,
+		}
+		if rd, ok := rr.RData.(OPTRecord); ok {
+			e.Options = rd.Options
+		}
+		return e, true
+	}
+	return EDNS{}, false
+}
+
+// GetRCode returns the full RCODE of the message, including the upper bits
+// carried in the OPT record when one is present.
+func (m DNSMessage) GetRCode() RCode {
+	rcode := m.Header.GetRCode()
+	if e, ok := m.GetEDNS(); ok {
+		rcode |= RCode(e.ExtendedRCode) << 4
+	}
+	return rcode
+}
+
+func (r *dnsReader) validateEDNS(m DNSMessage) error {
+	count := 0
+	for _, rr := range m.Additionals {
+		if rr.Type != RTOPT {
+			continue
+		}
+		count++
+		if rr.Name != "." {
+			return FormError{errors.New("OPT record owner must be root"), r.id}
+		}
+	}
+	if count > 1 {
+		return FormError{errors.New("Multiple OPT records"), r.id}
+	}
+	for _, rrs := range [][]DNSResourceRecord{m.Answers, m.Authorities} {
+		for _, rr := range rrs {
+			if rr.Type == RTOPT {
+				return FormError{errors.New("OPT record outside of additional section"), r.id}
+			}
+		}
+	}
+	return nil
+}
+
 func ParseDNSMessage(query []byte, mode MessageType) (DNSMessage, error) {
 	m := DNSMessage{}
 	var err error
@@ -592,9 +678,6 @@ func ParseDNSMessage(query []byte, mode MessageType) (DNSMessage, error) {
 	if m.Questions, err = r.parseDNSQuestion(m.Header.QDCount); err != nil {
 		return DNSMessage{}, err
 	}
-	if mode == Query {
-		return m, nil
-	}
 	if m.Answers, err = r.parseDNSResourceRecord(m.Header.ANCount); err != nil {
 		return DNSMessage{}, err
 	}
@@ -604,5 +687,11 @@ func ParseDNSMessage(query []byte, mode MessageType) (DNSMessage, error) {
 	if m.Additionals, err = r.parseDNSResourceRecord(m.Header.ARCount); err != nil {
 		return DNSMessage{}, err
 	}
+	if err = r.validateEDNS(m); err != nil {
+		return DNSMessage{}, err
+	}
+	if e, ok := m.GetEDNS(); ok && mode == Query && e.Version > 0 {
+		return DNSMessage{}, BadVersError{fmt.Errorf("Unsupported EDNS version %d", e.Version), r.id}
+	}
 	return m, nil
 }
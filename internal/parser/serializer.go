@@ -1,9 +1,10 @@
 package parser
 
 import (
+	"crypto/rand"
 	"encoding/binary"
-	"math/rand"
 	"net"
+	"slices"
 	"strings"
 )
 
@@ -36,19 +37,27 @@ func (s *dnsWriter) writeString(v string) {
 	s.writeBytes([]byte(v))
 }
 
+const maxPointerOffset = 0x3FFF
+
 func (s *dnsWriter) writePointer(offset int) {
 	s.writeUint16((uint16(PointerMask) << 8) | uint16(offset))
 }
 
-func (s *dnsWriter) writeName(v string) {
+// writeName writes v as a sequence of labels. When compress is set, the
+// longest suffix already present in the message is replaced by a pointer.
+func (s *dnsWriter) writeName(v string, compress bool) {
+	if v == "." || v == "" {
+		s.writeByte(0)
+		return
+	}
 	tokens := strings.Split(v, ".")
 	for i, token := range tokens {
 		suffix := strings.Join(tokens[i:], ".")
 		offset, ok := s.names[suffix]
-		if ok {
+		if ok && compress {
 			s.writePointer(offset)
 			return
-		} else if token != "" {
+		} else if !ok && token != "" && len(s.data) <= maxPointerOffset {
 			s.names[suffix] = len(s.data)
 		}
 		s.writeString(token)
@@ -62,6 +71,10 @@ func (s *dnsWriter) writeIP(v net.IP) {
 	s.data = append(s.data, v.To4()...)
 }
 
+func (s *dnsWriter) writeIPv6(v net.IP) {
+	s.data = append(s.data, v.To16()...)
+}
+
 func (h *DNSHeader) setQR(b bool) {
 	h.flags &^= QRMask
 	if b {
@@ -117,24 +130,24 @@ func (s *dnsWriter) serializeARecord(r ARecord) {
 }
 
 func (s *dnsWriter) serializeNSRecord(r NSRecord) {
-	s.writeName(r.Name)
+	s.writeName(r.Name, true)
 }
 
 func (s *dnsWriter) serializeMDRecord(r MDRecord) {
-	s.writeName(r.Name)
+	s.writeName(r.Name, false)
 }
 
 func (s *dnsWriter) serializeMFRecord(r MFRecord) {
-	s.writeName(r.Name)
+	s.writeName(r.Name, false)
 }
 
 func (s *dnsWriter) serializeCNameRecord(r CNameRecord) {
-	s.writeName(r.Name)
+	s.writeName(r.Name, true)
 }
 
 func (s *dnsWriter) serializeSOARecord(r SOARecord) {
-	s.writeName(r.MName)
-	s.writeName(r.RName)
+	s.writeName(r.MName, true)
+	s.writeName(r.RName, true)
 	s.writeUint32(r.Serial)
 	s.writeUint32(r.Refresh)
 	s.writeUint32(r.Retry)
@@ -143,15 +156,15 @@ func (s *dnsWriter) serializeSOARecord(r SOARecord) {
 }
 
 func (s *dnsWriter) serializeMBRecord(r MBRecord) {
-	s.writeName(r.Name)
+	s.writeName(r.Name, false)
 }
 
 func (s *dnsWriter) serializeMGRecord(r MGRecord) {
-	s.writeName(r.Name)
+	s.writeName(r.Name, false)
 }
 
 func (s *dnsWriter) serializeMRRecord(r MRRecord) {
-	s.writeName(r.Name)
+	s.writeName(r.Name, false)
 }
 
 func (s *dnsWriter) serializeNullRecord(r NullRecord) {
@@ -165,7 +178,7 @@ func (s *dnsWriter) serializeWKSRecord(r WKSRecord) {
 }
 
 func (s *dnsWriter) serializePTRRecord(r PTRRecord) {
-	s.writeName(r.Name)
+	s.writeName(r.Name, true)
 }
 
 func (s *dnsWriter) serializeHInfoRecord(r HInfoRecord) {
@@ -174,13 +187,13 @@ func (s *dnsWriter) serializeHInfoRecord(r HInfoRecord) {
 }
 
 func (s *dnsWriter) serializeMInfoRecord(r MInfoRecord) {
-	s.writeString(r.RMailBX)
-	s.writeString(r.EMailBX)
+	s.writeName(r.RMailBX, false)
+	s.writeName(r.EMailBX, false)
 }
 
 func (s *dnsWriter) serializeMXRecord(r MXRecord) {
 	s.writeUint16(r.Preference)
-	s.writeString(r.Exchange)
+	s.writeName(r.Exchange, true)
 }
 
 func (s *dnsWriter) serializeTXTRecord(r TXTRecord) {
@@ -189,6 +202,18 @@ func (s *dnsWriter) serializeTXTRecord(r TXTRecord) {
 	}
 }
 
+func (s *dnsWriter) serializeAAAARecord(r AAAARecord) {
+	s.writeIPv6(r.IP)
+}
+
+func (s *dnsWriter) serializeOPTRecord(r OPTRecord) {
+	for _, o := range r.Options {
+		s.writeUint16(o.Code)
+		s.writeUint16(uint16(len(o.Data)))
+		s.writeBytes(o.Data)
+	}
+}
+
 func (s *dnsWriter) writeRData(rdata RData) {
 	switch rd := rdata.(type) {
 	case ARecord:
@@ -223,6 +248,10 @@ func (s *dnsWriter) writeRData(rdata RData) {
 		s.serializeMXRecord(rd)
 	case TXTRecord:
 		s.serializeTXTRecord(rd)
+	case AAAARecord:
+		s.serializeAAAARecord(rd)
+	case OPTRecord:
+		s.serializeOPTRecord(rd)
 	default:
 		return
 	}
@@ -239,7 +268,7 @@ func (s *dnsWriter) serializeDNSHeader(h DNSHeader) {
 
 func (s *dnsWriter) serializeDNSQuestion(qs []DNSQuestion) {
 	for _, q := range qs {
-		s.writeName(q.QName)
+		s.writeName(q.QName, true)
 		s.writeUint16(uint16(q.QType))
 		s.writeUint16(uint16(q.QClass))
 	}
@@ -247,12 +276,14 @@ func (s *dnsWriter) serializeDNSQuestion(qs []DNSQuestion) {
 
 func (s *dnsWriter) serializeDNSResourceRecord(rrs []DNSResourceRecord) {
 	for _, rr := range rrs {
-		s.writeName(rr.Name)
+		s.writeName(rr.Name, true)
 		s.writeUint16(uint16(rr.Type))
 		s.writeUint16(uint16(rr.Class))
 		s.writeUint32(rr.TTL)
-		s.writeUint16(rr.RDLength)
+		lengthPos := len(s.data)
+		s.writeUint16(0)
 		s.writeRData(rr.RData)
+		binary.BigEndian.PutUint16(s.data[lengthPos:], uint16(len(s.data)-lengthPos-2))
 	}
 }
 
@@ -266,27 +297,161 @@ func SerializeDNSMessage(m DNSMessage) []byte {
 	return s.data
 }
 
+const (
+	MinUDPSize = 512
+	MaxTCPSize = 0xFFFF
+)
+
+// GetUDPSize returns the largest UDP response the sender of query m can
+// accept, capped at the size we advertise ourselves.
+func (m DNSMessage) GetUDPSize() int {
+	e, ok := m.GetEDNS()
+	if !ok {
+		return MinUDPSize
+	}
+	return max(MinUDPSize, int(min(e.UDPSize, EDNSUDPSize)))
+}
+
+func dropLastRRset(rrs []DNSResourceRecord) []DNSResourceRecord {
+	last := rrs[len(rrs)-1]
+	res := make([]DNSResourceRecord, 0, len(rrs))
+	for _, rr := range rrs {
+		if !strings.EqualFold(rr.Name, last.Name) || rr.Type != last.Type || rr.Class != last.Class {
+			res = append(res, rr)
+		}
+	}
+	return res
+}
+
+func (m *DNSMessage) updateCounts() {
+	m.Header.QDCount = uint16(len(m.Questions))
+	m.Header.ANCount = uint16(len(m.Answers))
+	m.Header.NSCount = uint16(len(m.Authorities))
+	m.Header.ARCount = uint16(len(m.Additionals))
+}
+
+// SerializeTruncatedDNSMessage serializes m so that it fits in maxSize bytes.
+// Whole RRsets are dropped from the end of the message, additional records
+// first. As per RFC 2181 the TC bit is only set once records outside the
+// additional section had to be removed. The OPT record is always kept.
+func SerializeTruncatedDNSMessage(m DNSMessage, maxSize int) []byte {
+	data := SerializeDNSMessage(m)
+	if len(data) <= maxSize {
+		return data
+	}
+	var opt []DNSResourceRecord
+	additionals := make([]DNSResourceRecord, 0, len(m.Additionals))
+	for _, rr := range m.Additionals {
+		if rr.Type == RTOPT {
+			opt = append(opt, rr)
+		} else {
+			additionals = append(additionals, rr)
+		}
+	}
+	m.Answers = slices.Clone(m.Answers)
+	m.Authorities = slices.Clone(m.Authorities)
+	for len(data) > maxSize {
+		switch {
+		case len(additionals) > 0:
+			additionals = dropLastRRset(additionals)
+		case len(m.Authorities) > 0:
+			m.Authorities = dropLastRRset(m.Authorities)
+			m.Header.setTC(true)
+		case len(m.Answers) > 0:
+			m.Answers = dropLastRRset(m.Answers)
+			m.Header.setTC(true)
+		default:
+			m.Header.setTC(true)
+			m.updateCounts()
+			return SerializeDNSMessage(m)
+		}
+		m.Additionals = append(slices.Clone(additionals), opt...)
+		m.updateCounts()
+		data = SerializeDNSMessage(m)
+	}
+	return data
+}
+
 func generateID() uint16 {
-	return uint16(rand.Intn(1 << 16))
+	buf := make([]byte, 2)
+	rand.Read(buf)
+	return binary.BigEndian.Uint16(buf)
+}
+
+func CreateOPTRecord(e EDNS) DNSResourceRecord {
+	ttl := uint32(e.ExtendedRCode)<<24 | uint32(e.Version)<<16
+	if e.DO {
+		ttl |= DOMask
+	}
+	length := 0
+	for _, o := range e.Options {
+		length += 4 + len(o.Data)
+	}
+	return DNSResourceRecord{
+		Name:     ".",
+		Type:     RTOPT,
+		Class:    RecordClass(e.UDPSize),
+		TTL:      ttl,
+		RDLength: uint16(length),
+		RData:    OPTRecord{Options: e.Options},
+	}
+}
+
+// setRCode sets the RCODE of the message, storing the upper bits of an
+// extended RCODE in the OPT record.
+func (m *DNSMessage) setRCode(rcode RCode) {
+	m.Header.setRCode(uint8(rcode))
+	for i, rr := range m.Additionals {
+		if rr.Type == RTOPT {
+			m.Additionals[i].TTL = rr.TTL&^ExtendedRCodeMask | uint32(rcode>>4)<<24
+		}
+	}
+}
+
+func (m *DNSMessage) addEDNS(e EDNS) {
+	m.Additionals = append(m.Additionals, CreateOPTRecord(e))
+	m.Header.ARCount = uint16(len(m.Additionals))
 }
 
 func CreateAnswerMessage(q DNSMessage, answers []DNSResourceRecord) DNSMessage {
+	return CreateResponseMessage(q, NoError, answers, nil)
+}
+
+func CreateResponseMessage(q DNSMessage, rcode RCode, answers []DNSResourceRecord, authorities []DNSResourceRecord) DNSMessage {
 	header := DNSHeader{
 		ID:      q.Header.ID,
 		QDCount: q.Header.QDCount,
 		ANCount: uint16(len(answers)),
+		NSCount: uint16(len(authorities)),
 	}
 	header.setQR(true)
 	header.setRA(true)
-	return DNSMessage{
-		Header:    header,
-		Questions: q.Questions,
-		Answers:   answers,
+	m := DNSMessage{
+		Header:      header,
+		Questions:   q.Questions,
+		Answers:     answers,
+		Authorities: authorities,
 	}
+	if e, ok := q.GetEDNS(); ok {
+		m.addEDNS(EDNS{UDPSize: EDNSUDPSize, DO: e.DO})
+	}
+	m.setRCode(rcode)
+	return m
 }
 
-func CreateQuery(domain string, qtype RecordType, qclass RecordClass) []byte {
-	return SerializeDNSMessage(DNSMessage{
+// CreateAuthoritativeResponseMessage creates a response from zone data we
+// serve. The AA bit is set unless aa is false, as for referrals to servers
+// of a child zone.
+func CreateAuthoritativeResponseMessage(q DNSMessage, rcode RCode, aa bool, answers []DNSResourceRecord, authorities []DNSResourceRecord, additionals []DNSResourceRecord) DNSMessage {
+	m := CreateResponseMessage(q, rcode, answers, authorities)
+	m.Header.setAA(aa)
+	m.Additionals = append(slices.Clone(additionals), m.Additionals...)
+	m.updateCounts()
+	return m
+}
+
+func createQueryMessage(domain string, qtype RecordType, qclass RecordClass) DNSMessage {
+	return DNSMessage{
 		Header: DNSHeader{
 			ID:      generateID(),
 			QDCount: 1,
@@ -298,17 +463,63 @@ func CreateQuery(domain string, qtype RecordType, qclass RecordClass) []byte {
 				QClass: qclass,
 			},
 		},
-	})
+	}
+}
+
+func CreateQuery(domain string, qtype RecordType, qclass RecordClass) []byte {
+	return SerializeDNSMessage(createQueryMessage(domain, qtype, qclass))
+}
+
+func CreateEDNSQuery(domain string, qtype RecordType, qclass RecordClass, udpSize uint16) []byte {
+	m := createQueryMessage(domain, qtype, qclass)
+	m.addEDNS(EDNS{UDPSize: udpSize})
+	return SerializeDNSMessage(m)
+}
+
+// CreateRecursiveQuery creates a query with the RD bit set, for sending to
+// another recursive resolver. A udpSize of zero leaves out the OPT record.
+func CreateRecursiveQuery(domain string, qtype RecordType, qclass RecordClass, udpSize uint16) []byte {
+	m := createQueryMessage(domain, qtype, qclass)
+	m.Header.setRD(true)
+	if udpSize > 0 {
+		m.addEDNS(EDNS{UDPSize: udpSize})
+	}
+	return SerializeDNSMessage(m)
+}
+
+func getErrorRCode(err CustomError) RCode {
+	switch err.(type) {
+	case FormError:
+		return FormErr
+	case ServFailError:
+		return ServFail
+	case NXDomainError:
+		return NXDomain
+	case NotImpError:
+		return NotImp
+	case RefusedError:
+		return Refused
+	case BadVersError:
+		return BadVers
+	}
+	return ServFail
 }
 
-func CreateErrorResponseMessage(err CustomError) DNSMessage {
+func CreateErrorResponseMessage(err CustomError, questions []DNSQuestion) DNSMessage {
 	header := DNSHeader{
-		ID: err.GetID(),
+		ID:      err.GetID(),
+		QDCount: uint16(len(questions)),
 	}
 	header.setQR(true)
 	header.setRA(true)
-	header.setRCode(uint8(FormErr))
-	return DNSMessage{
-		Header: header,
+	m := DNSMessage{
+		Header:    header,
+		Questions: questions,
+	}
+	rcode := getErrorRCode(err)
+	if rcode > RCodeMask {
+		m.addEDNS(EDNS{UDPSize: EDNSUDPSize})
 	}
+	m.setRCode(rcode)
+	return m
 }
@@ -2,6 +2,7 @@ package parser
 
 import (
 	"bytes"
+	"net"
 	"testing"
 )
 
@@ -90,3 +91,199 @@ func TestCreateQuery_SerializesToExpectedBytes(t *testing.T) {
 		})
 	}
 }
+
+func TestCreateErrorResponseMessage_RCode(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         CustomError
+		expectRCode RCode
+	}{
+		{"form error", FormError{ID: 1}, FormErr},
+		{"server failure", ServFailError{ID: 2}, ServFail},
+		{"non-existent domain", NXDomainError{ID: 3}, NXDomain},
+		{"not implemented", NotImpError{ID: 4}, NotImp},
+		{"refused", RefusedError{ID: 5}, Refused},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			questions := []DNSQuestion{{QName: "example.com.", QType: RTA, QClass: RCIN}}
+			msg := CreateErrorResponseMessage(tt.err, questions)
+			if msg.Header.ID != tt.err.GetID() {
+				t.Errorf("expected ID %d, got %d", tt.err.GetID(), msg.Header.ID)
+			}
+			if msg.Header.GetRCode() != tt.expectRCode {
+				t.Errorf("expected RCODE %v, got %v", tt.expectRCode, msg.Header.GetRCode())
+			}
+			if !msg.Header.GetQR() {
+				t.Error("expected QR bit to be set")
+			}
+			if msg.Header.QDCount != 1 || len(msg.Questions) != 1 || msg.Questions[0] != questions[0] {
+				t.Errorf("expected question to be echoed, got %v", msg.Questions)
+			}
+		})
+	}
+}
+
+func TestSerializeDNSMessage_AAAARoundTrip(t *testing.T) {
+	ip := net.ParseIP("2001:db8::1")
+	q := createQueryMessage("example.com.", RTAAAA, RCIN)
+	msg := CreateAnswerMessage(q, []DNSResourceRecord{
+		{
+			Name:     "example.com.",
+			Type:     RTAAAA,
+			Class:    RCIN,
+			TTL:      300,
+			RDLength: 16,
+			RData:    AAAARecord{IP: ip},
+		},
+	})
+
+	parsed, err := ParseDNSMessage(SerializeDNSMessage(msg), Response)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(parsed.Answers) != 1 {
+		t.Fatalf("expected 1 answer, got %d", len(parsed.Answers))
+	}
+	rd, ok := parsed.Answers[0].RData.(AAAARecord)
+	if !ok || !rd.IP.Equal(ip) {
+		t.Errorf("expected AAAA %v, got %v", ip, parsed.Answers[0].RData)
+	}
+}
+
+func TestSerializeDNSMessage_ComputesRDLengthRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		rtype RecordType
+		rdata RData
+	}{
+		{"A", RTA, ARecord{IP: net.IPv4(192, 0, 2, 1).To4()}},
+		{"NS", RTNS, NSRecord{Name: "ns1.example.com."}},
+		{"CNAME", RTCNAME, CNameRecord{Name: "www.example.com."}},
+		{"SOA", RTSOA, SOARecord{MName: "ns1.example.com.", RName: "hostmaster.example.com.", Serial: 1, Refresh: 2, Retry: 3, Expire: 4, Minimum: 5}},
+		{"MB", RTMB, MBRecord{Name: "mail.example.com."}},
+		{"PTR", RTPTR, PTRRecord{Name: "host.example.com."}},
+		{"MINFO", RTMINFO, MInfoRecord{RMailBX: "admin.example.com.", EMailBX: "errors.example.com."}},
+		{"MX", RTMX, MXRecord{Preference: 10, Exchange: "mx.example.com."}},
+		{"TXT", RTTXT, TXTRecord{Data: []string{"v=spf1 -all", "hello"}}},
+		{"AAAA", RTAAAA, AAAARecord{IP: net.ParseIP("2001:db8::1")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := createQueryMessage("example.com.", tt.rtype, RCIN)
+			msg := CreateAnswerMessage(q, []DNSResourceRecord{
+				{Name: "example.com.", Type: tt.rtype, Class: RCIN, TTL: 60, RData: tt.rdata},
+			})
+
+			parsed, err := ParseDNSMessage(SerializeDNSMessage(msg), Response)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(parsed.Answers) != 1 {
+				t.Fatalf("expected 1 answer, got %d", len(parsed.Answers))
+			}
+			if parsed.Answers[0].RData.String() != tt.rdata.String() {
+				t.Errorf("expected RData %v, got %v", tt.rdata, parsed.Answers[0].RData)
+			}
+		})
+	}
+}
+
+func TestSerializeDNSMessage_CompressesRData(t *testing.T) {
+	tests := []struct {
+		name           string
+		rtype          RecordType
+		rdata          RData
+		expectCompress bool
+	}{
+		{"NS", RTNS, NSRecord{Name: "ns1.example.com."}, true},
+		{"CNAME", RTCNAME, CNameRecord{Name: "www.example.com."}, true},
+		{"PTR", RTPTR, PTRRecord{Name: "host.example.com."}, true},
+		{"MX", RTMX, MXRecord{Preference: 10, Exchange: "mx.example.com."}, true},
+		{"SOA", RTSOA, SOARecord{MName: "ns1.example.com.", RName: "hostmaster.example.com."}, true},
+		{"MB", RTMB, MBRecord{Name: "mail.example.com."}, false},
+		{"MINFO", RTMINFO, MInfoRecord{RMailBX: "admin.example.com.", EMailBX: "errors.example.com."}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := createQueryMessage("example.com.", tt.rtype, RCIN)
+			msg := CreateAnswerMessage(q, []DNSResourceRecord{
+				{Name: "example.com.", Type: tt.rtype, Class: RCIN, TTL: 60, RData: tt.rdata},
+			})
+			wire := SerializeDNSMessage(msg)
+
+			// Header, question and the fixed part of the answer precede RDATA.
+			rdataStart := 12 + len("example.com.") + 1 + 4 + 2 + 10
+			rdata := wire[rdataStart:]
+			hasPointer := bytes.Contains(rdata, []byte{0xc0, 0x0c})
+			if hasPointer != tt.expectCompress {
+				t.Errorf("expected compression %v, RDATA was %v", tt.expectCompress, rdata)
+			}
+			length := int(wire[rdataStart-2])<<8 | int(wire[rdataStart-1])
+			if length != len(rdata) {
+				t.Errorf("expected RDLENGTH %d, got %d", len(rdata), length)
+			}
+		})
+	}
+}
+
+func TestCreateAuthoritativeResponseMessage(t *testing.T) {
+	q := createQueryMessage("example.com.", RTNS, RCIN)
+	q.addEDNS(EDNS{UDPSize: 4096})
+	ns := DNSResourceRecord{Name: "example.com.", Type: RTNS, Class: RCIN, TTL: 3600, RData: NSRecord{Name: "ns1.example.com."}}
+	glue := DNSResourceRecord{Name: "ns1.example.com.", Type: RTA, Class: RCIN, TTL: 3600, RData: ARecord{IP: net.IPv4(192, 0, 2, 1).To4()}}
+
+	tests := []struct {
+		name string
+		aa   bool
+	}{
+		{"answer", true},
+		{"referral", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := CreateAuthoritativeResponseMessage(q, NoError, tt.aa, []DNSResourceRecord{ns}, nil, []DNSResourceRecord{glue})
+			parsed, err := ParseDNSMessage(SerializeDNSMessage(m), Response)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if parsed.Header.GetAA() != tt.aa {
+				t.Errorf("expected AA %v", tt.aa)
+			}
+			if len(parsed.Additionals) != 2 || parsed.Additionals[0].Type != RTA || parsed.Additionals[1].Type != RTOPT {
+				t.Errorf("expected glue followed by OPT, got %v", parsed.Additionals)
+			}
+		})
+	}
+}
+
+func TestCreateRecursiveQuery(t *testing.T) {
+	tests := []struct {
+		name       string
+		udpSize    uint16
+		expectEDNS bool
+	}{
+		{"with EDNS", EDNSUDPSize, true},
+		{"without EDNS", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := ParseDNSMessage(CreateRecursiveQuery("example.com.", RTA, RCIN, tt.udpSize), Query)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !msg.Header.GetRD() {
+				t.Error("expected RD bit to be set")
+			}
+			e, ok := msg.GetEDNS()
+			if ok != tt.expectEDNS || ok && e.UDPSize != tt.udpSize {
+				t.Errorf("unexpected EDNS %v, present %v", e, ok)
+			}
+		})
+	}
+}
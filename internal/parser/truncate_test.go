@@ -0,0 +1,144 @@
+package parser
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func makeTestARecords(name string, n int) []DNSResourceRecord {
+	rrs := make([]DNSResourceRecord, n)
+	for i := range rrs {
+		rrs[i] = DNSResourceRecord{
+			Name:  name,
+			Type:  RTA,
+			Class: RCIN,
+			TTL:   60,
+			RData: ARecord{IP: net.IPv4(192, 0, 2, byte(i)).To4()},
+		}
+	}
+	return rrs
+}
+
+func TestSerializeTruncatedDNSMessage(t *testing.T) {
+	q := createQueryMessage("example.com.", RTA, RCIN)
+	ednsQuery := createQueryMessage("example.com.", RTA, RCIN)
+	ednsQuery.addEDNS(EDNS{UDPSize: 4096})
+
+	glue := make([]DNSResourceRecord, 0)
+	for i := 0; i < 10; i++ {
+		glue = append(glue, makeTestARecords(fmt.Sprintf("ns%d.example.com.", i), 2)...)
+	}
+
+	tests := []struct {
+		name              string
+		msg               DNSMessage
+		maxSize           int
+		expectTC          bool
+		expectAnswers     int
+		expectAdditionals int
+		expectEDNS        bool
+	}{
+		{
+			name:          "fits without truncation",
+			msg:           CreateAnswerMessage(q, makeTestARecords("example.com.", 4)),
+			maxSize:       MinUDPSize,
+			expectAnswers: 4,
+		},
+		{
+			name:          "answer RRset dropped",
+			msg:           CreateAnswerMessage(q, makeTestARecords("example.com.", 40)),
+			maxSize:       MinUDPSize,
+			expectTC:      true,
+			expectAnswers: 0,
+		},
+		{
+			name: "additional RRsets dropped without TC",
+			msg: func() DNSMessage {
+				m := CreateAnswerMessage(q, makeTestARecords("example.com.", 4))
+				m.Additionals = glue
+				m.updateCounts()
+				return m
+			}(),
+			maxSize:           200,
+			expectAnswers:     4,
+			expectAdditionals: 4,
+		},
+		{
+			name:          "larger EDNS buffer avoids truncation",
+			msg:           CreateAnswerMessage(ednsQuery, makeTestARecords("example.com.", 40)),
+			maxSize:       ednsQuery.GetUDPSize(),
+			expectAnswers: 40,
+			expectEDNS:    true,
+		},
+		{
+			name: "OPT record is kept",
+			msg: func() DNSMessage {
+				m := CreateAnswerMessage(ednsQuery, makeTestARecords("example.com.", 40))
+				m.Additionals = append(glue, m.Additionals...)
+				m.updateCounts()
+				return m
+			}(),
+			maxSize:       MinUDPSize,
+			expectTC:      true,
+			expectAnswers: 0,
+			expectEDNS:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wire := SerializeTruncatedDNSMessage(tt.msg, tt.maxSize)
+			if len(wire) > tt.maxSize {
+				t.Fatalf("expected at most %d bytes, got %d", tt.maxSize, len(wire))
+			}
+			parsed, err := ParseDNSMessage(wire, Response)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if parsed.Header.GetTC() != tt.expectTC {
+				t.Errorf("expected TC %v, got %v", tt.expectTC, parsed.Header.GetTC())
+			}
+			if len(parsed.Answers) != tt.expectAnswers {
+				t.Errorf("expected %d answers, got %d", tt.expectAnswers, len(parsed.Answers))
+			}
+			_, hasEDNS := parsed.GetEDNS()
+			if hasEDNS != tt.expectEDNS {
+				t.Errorf("expected EDNS %v, got %v", tt.expectEDNS, hasEDNS)
+			}
+			additionals := len(parsed.Additionals)
+			if hasEDNS {
+				additionals--
+			}
+			if additionals != tt.expectAdditionals {
+				t.Errorf("expected %d additionals, got %d", tt.expectAdditionals, additionals)
+			}
+		})
+	}
+}
+
+func TestGetUDPSize(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   uint16
+		edns   bool
+		expect int
+	}{
+		{"no EDNS", 0, false, MinUDPSize},
+		{"small EDNS buffer", 256, true, MinUDPSize},
+		{"medium EDNS buffer", 1000, true, 1000},
+		{"large EDNS buffer", 4096, true, int(EDNSUDPSize)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := createQueryMessage("example.com.", RTA, RCIN)
+			if tt.edns {
+				q.addEDNS(EDNS{UDPSize: tt.size})
+			}
+			if got := q.GetUDPSize(); got != tt.expect {
+				t.Errorf("expected %d, got %d", tt.expect, got)
+			}
+		})
+	}
+}
@@ -37,6 +37,8 @@ const (
 
 	RTAAAA RecordType = 28
 
+	RTOPT RecordType = 41
+
 	RTAXFR  RecordType = 252
 	RTMAILB RecordType = 253
 	RTMAILA RecordType = 254
@@ -77,6 +79,10 @@ func (rt RecordType) String() string {
 		return "MX"
 	case RTTXT:
 		return "TXT"
+	case RTAAAA:
+		return "AAAA"
+	case RTOPT:
+		return "OPT"
 	case RTAXFR:
 		return "AXFR"
 	case RTMAILB:
@@ -205,6 +211,23 @@ func (e RefusedError) GetID() uint16 {
 	return e.ID
 }
 
+type BadVersError struct {
+	Err error
+	ID  uint16
+}
+
+func (e BadVersError) Error() string {
+	return fmt.Sprintf("BADVERS(id=%d): %v", e.ID, e.Err)
+}
+
+func (e BadVersError) Unwrap() error {
+	return e.Err
+}
+
+func (e BadVersError) GetID() uint16 {
+	return e.ID
+}
+
 type OpCode uint8
 
 const (
@@ -234,6 +257,8 @@ const (
 	NXDomain
 	NotImp
 	Refused
+
+	BadVers RCode = 16
 )
 
 func (rc RCode) String() string {
@@ -250,6 +275,8 @@ func (rc RCode) String() string {
 		return "NOTIMP"
 	case Refused:
 		return "REFUSED"
+	case BadVers:
+		return "BADVERS"
 	}
 	return "?"
 }
@@ -265,6 +292,16 @@ const (
 	RCodeMask  = 0x000F
 )
 
+const (
+	ExtendedRCodeMask = 0xFF000000
+	VersionMask       = 0x00FF0000
+	DOMask            = 0x00008000
+)
+
+// EDNSUDPSize is the UDP payload size advertised in our own OPT records, as
+// recommended by DNS Flag Day 2020.
+const EDNSUDPSize uint16 = 1232
+
 const PointerMask = 0xC0
 const OffsetMask = 0x3F
 
@@ -431,6 +468,41 @@ func (r AAAARecord) String() string {
 	return r.IP.String()
 }
 
+type EDNSOption struct {
+	Code uint16
+	Data []byte
+}
+
+type OPTRecord struct {
+	Options []EDNSOption
+}
+
+func (r OPTRecord) String() string {
+	res := ""
+	for _, o := range r.Options {
+		res += fmt.Sprintf("%d:%x;", o.Code, o.Data)
+	}
+	return res
+}
+
+// EDNS holds the fields of an OPT pseudo-record, which are packed into the
+// CLASS and TTL fields on the wire (RFC 6891).
+type EDNS struct {
+	UDPSize       uint16
+	ExtendedRCode uint8
+	Version       uint8
+	DO            bool
+	Options       []EDNSOption
+}
+
+func (e EDNS) String() string {
+	flags := ""
+	if e.DO {
+		flags = "do"
+	}
+	return fmt.Sprintf("EDNS: version: %d, flags: %s; udp: %d", e.Version, flags, e.UDPSize)
+}
+
 type DNSHeader struct {
 	ID      uint16
 	flags   uint16
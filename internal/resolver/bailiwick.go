@@ -0,0 +1,97 @@
+package resolver
+
+import (
+	"dns/internal/parser"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+func canonicalName(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
+
+func isSubdomain(name string, zone string) bool {
+	name = canonicalName(name)
+	zone = canonicalName(zone)
+	return zone == "." || name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// validateResponse checks that msg answers the query we sent, so that a
+// response meant for a different query cannot be accepted in its place.
+func validateResponse(query []byte, msg parser.DNSMessage, domain string, qtype parser.RecordType, qclass parser.RecordClass) error {
+	if len(query) < 2 || msg.Header.ID != binary.BigEndian.Uint16(query[:2]) {
+		return errors.New("Response ID does not match query")
+	}
+	if len(msg.Questions) != 1 {
+		return errors.New("Response does not echo the question")
+	}
+	q := msg.Questions[0]
+	if canonicalName(q.QName) != canonicalName(domain) || q.QType != qtype || q.QClass != qclass {
+		return fmt.Errorf("Response is for a different question: %v", q)
+	}
+	return nil
+}
+
+func filterRecords(rrs []parser.DNSResourceRecord, keep func(parser.DNSResourceRecord) bool) ([]parser.DNSResourceRecord, int) {
+	res := make([]parser.DNSResourceRecord, 0, len(rrs))
+	for _, rr := range rrs {
+		if keep(rr) {
+			res = append(res, rr)
+		}
+	}
+	return res, len(rrs) - len(res)
+}
+
+// sanitizeResponse drops every record a server authoritative for zone has no
+// business telling us about. Answers and authority records must be owned by
+// names inside zone, referrals must lead from zone towards domain, and glue
+// is only kept for names inside zone. A referral that is entirely rejected
+// is reported as an error, since following it could loop or be poisoned.
+func sanitizeResponse(msg parser.DNSMessage, zone string, domain string) (parser.DNSMessage, int, error) {
+	inZone := func(rr parser.DNSResourceRecord) bool {
+		return isSubdomain(rr.Name, zone)
+	}
+	res := msg
+	var dropped, n int
+	res.Answers, n = filterRecords(msg.Answers, inZone)
+	dropped += n
+	res.Authorities, n = filterRecords(msg.Authorities, func(rr parser.DNSResourceRecord) bool {
+		if !inZone(rr) {
+			return false
+		}
+		if rr.Type == parser.RTNS {
+			return isSubdomain(domain, rr.Name) && canonicalName(rr.Name) != canonicalName(zone)
+		}
+		return rr.Type != parser.RTSOA || isSubdomain(domain, rr.Name)
+	})
+	dropped += n
+	res.Additionals, n = filterRecords(msg.Additionals, func(rr parser.DNSResourceRecord) bool {
+		return rr.Type == parser.RTOPT || inZone(rr)
+	})
+	dropped += n
+	if len(res.Answers) == 0 && isReferral(msg) && !isReferral(res) && res.Header.GetRCode() == parser.NoError {
+		if _, ok := getSOA(res.Authorities); !ok {
+			return parser.DNSMessage{}, dropped, fmt.Errorf("Rejected referral for %s from servers for %s", domain, zone)
+		}
+	}
+	res.Header.ANCount = uint16(len(res.Answers))
+	res.Header.NSCount = uint16(len(res.Authorities))
+	res.Header.ARCount = uint16(len(res.Additionals))
+	return res, dropped, nil
+}
+
+// getReferralZone returns the zone a sanitized referral delegates to.
+func getReferralZone(msg parser.DNSMessage) string {
+	for _, rr := range msg.Authorities {
+		if rr.Type == parser.RTNS {
+			return canonicalName(rr.Name)
+		}
+	}
+	return ""
+}
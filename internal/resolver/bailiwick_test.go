@@ -0,0 +1,216 @@
+package resolver
+
+import (
+	"dns/internal/parser"
+	"net"
+	"testing"
+)
+
+func makeGlue(name string, ip net.IP) parser.DNSResourceRecord {
+	return parser.DNSResourceRecord{
+		Name:  name,
+		Type:  parser.RTA,
+		Class: parser.RCIN,
+		TTL:   172800,
+		RData: parser.ARecord{IP: ip},
+	}
+}
+
+func TestSanitizeResponse_PoisoningAttempts(t *testing.T) {
+	attacker := net.IPv4(203, 0, 113, 66)
+	tests := []struct {
+		name              string
+		zone              string
+		domain            string
+		msg               parser.DNSMessage
+		expectError       bool
+		expectAnswers     int
+		expectAuthorities int
+		expectAdditionals int
+	}{
+		{
+			name:   "legitimate referral with in-bailiwick glue",
+			zone:   "com.",
+			domain: "www.example.com.",
+			msg: parser.DNSMessage{
+				Authorities: []parser.DNSResourceRecord{makeNSRecord("example.com.", "ns1.example.com.")},
+				Additionals: []parser.DNSResourceRecord{makeGlue("ns1.example.com.", net.IPv4(192, 0, 2, 53))},
+			},
+			expectAuthorities: 1,
+			expectAdditionals: 1,
+		},
+		{
+			name:   "glue for a name outside the zone",
+			zone:   "com.",
+			domain: "www.example.com.",
+			msg: parser.DNSMessage{
+				Authorities: []parser.DNSResourceRecord{makeNSRecord("example.com.", "ns1.example.com.")},
+				Additionals: []parser.DNSResourceRecord{
+					makeGlue("ns1.example.com.", net.IPv4(192, 0, 2, 53)),
+					makeGlue("www.bank.org.", attacker),
+				},
+			},
+			expectAuthorities: 1,
+			expectAdditionals: 1,
+		},
+		{
+			name:   "referral for a zone unrelated to the query",
+			zone:   "com.",
+			domain: "www.example.com.",
+			msg: parser.DNSMessage{
+				Authorities: []parser.DNSResourceRecord{
+					makeNSRecord("example.com.", "ns1.example.com."),
+					makeNSRecord("bank.com.", "ns.evil.com."),
+				},
+			},
+			expectAuthorities: 1,
+		},
+		{
+			name:   "upward referral to the root",
+			zone:   "example.com.",
+			domain: "www.example.com.",
+			msg: parser.DNSMessage{
+				Authorities: []parser.DNSResourceRecord{makeNSRecord(".", "a.root-servers.net.")},
+			},
+			expectError: true,
+		},
+		{
+			name:   "referral entirely outside the zone",
+			zone:   "example.com.",
+			domain: "www.example.com.",
+			msg: parser.DNSMessage{
+				Authorities: []parser.DNSResourceRecord{makeNSRecord("org.", "ns.evil.org.")},
+				Additionals: []parser.DNSResourceRecord{makeGlue("ns.evil.org.", attacker)},
+			},
+			expectError: true,
+		},
+		{
+			name:   "answer with out-of-zone records appended",
+			zone:   "example.com.",
+			domain: "www.example.com.",
+			msg: parser.DNSMessage{
+				Answers: []parser.DNSResourceRecord{
+					makeCNameRecord("www.example.com.", "cdn.example.net."),
+					makeGlue("cdn.example.net.", attacker),
+					makeGlue("www.bank.org.", attacker),
+				},
+				Additionals: []parser.DNSResourceRecord{makeGlue("ns1.bank.org.", attacker)},
+			},
+			expectAnswers: 1,
+		},
+		{
+			name:   "SOA for an unrelated zone",
+			zone:   "example.com.",
+			domain: "missing.example.com.",
+			msg: parser.DNSMessage{
+				Authorities: []parser.DNSResourceRecord{
+					makeSOARecord("example.com.", 300, 300),
+					makeSOARecord("sub.example.com.", 300, 300),
+				},
+			},
+			expectAuthorities: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, _, err := sanitizeResponse(tt.msg, tt.zone, tt.domain)
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(msg.Answers) != tt.expectAnswers {
+				t.Errorf("expected %d answers, got %v", tt.expectAnswers, msg.Answers)
+			}
+			if len(msg.Authorities) != tt.expectAuthorities {
+				t.Errorf("expected %d authorities, got %v", tt.expectAuthorities, msg.Authorities)
+			}
+			if len(msg.Additionals) != tt.expectAdditionals {
+				t.Errorf("expected %d additionals, got %v", tt.expectAdditionals, msg.Additionals)
+			}
+			for _, rr := range msg.Additionals {
+				if ip := getRecordIP(rr); ip != nil && ip.Equal(attacker) {
+					t.Errorf("attacker address survived sanitization: %v", rr)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateResponse(t *testing.T) {
+	query := parser.CreateQuery("example.com.", parser.RTA, parser.RCIN)
+	id := uint16(query[0])<<8 | uint16(query[1])
+	question := parser.DNSQuestion{QName: "example.com.", QType: parser.RTA, QClass: parser.RCIN}
+
+	tests := []struct {
+		name        string
+		msg         parser.DNSMessage
+		expectError bool
+	}{
+		{
+			name: "matching response",
+			msg:  parser.DNSMessage{Header: parser.DNSHeader{ID: id}, Questions: []parser.DNSQuestion{question}},
+		},
+		{
+			name: "matching response with different case",
+			msg: parser.DNSMessage{Header: parser.DNSHeader{ID: id}, Questions: []parser.DNSQuestion{
+				{QName: "ExAmPlE.CoM.", QType: parser.RTA, QClass: parser.RCIN},
+			}},
+		},
+		{
+			name:        "spoofed ID",
+			msg:         parser.DNSMessage{Header: parser.DNSHeader{ID: id + 1}, Questions: []parser.DNSQuestion{question}},
+			expectError: true,
+		},
+		{
+			name: "different question",
+			msg: parser.DNSMessage{Header: parser.DNSHeader{ID: id}, Questions: []parser.DNSQuestion{
+				{QName: "bank.com.", QType: parser.RTA, QClass: parser.RCIN},
+			}},
+			expectError: true,
+		},
+		{
+			name:        "missing question",
+			msg:         parser.DNSMessage{Header: parser.DNSHeader{ID: id}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateResponse(query, tt.msg, "example.com.", parser.RTA, parser.RCIN)
+			if (err != nil) != tt.expectError {
+				t.Errorf("expected error %v, got %v", tt.expectError, err)
+			}
+		})
+	}
+}
+
+func TestIsSubdomain(t *testing.T) {
+	tests := []struct {
+		name   string
+		zone   string
+		expect bool
+	}{
+		{"www.example.com.", ".", true},
+		{"www.example.com.", "example.com.", true},
+		{"example.com.", "example.com.", true},
+		{"WWW.Example.COM.", "example.com.", true},
+		{"www.example.com", "example.com.", true},
+		{"badexample.com.", "example.com.", false},
+		{"example.com.", "www.example.com.", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name+" in "+tt.zone, func(t *testing.T) {
+			if got := isSubdomain(tt.name, tt.zone); got != tt.expect {
+				t.Errorf("expected %v, got %v", tt.expect, got)
+			}
+		})
+	}
+}
@@ -1,16 +1,27 @@
 package resolver
 
 import (
+	"container/list"
 	"dns/internal/parser"
 	"fmt"
+	"slices"
 	"sync"
 	"time"
 
 	"go.uber.org/zap"
 )
 
-type cachedResourceRecord struct {
-	record parser.DNSResourceRecord
+// cachedRRset holds every record sharing an owner name, type and class. The
+// set is stored and expires as a unit, using the lowest TTL of its members.
+type cachedRRset struct {
+	records []parser.DNSResourceRecord
+	expiry  time.Time
+	ttl     time.Duration
+}
+
+type negativeCacheEntry struct {
+	rcode  parser.RCode
+	soa    parser.DNSResourceRecord
 	expiry time.Time
 }
 
@@ -24,79 +35,433 @@ func (ck cacheKey) String() string {
 	return fmt.Sprintf("%s; %v; %v", ck.Name, ck.Class, ck.Type)
 }
 
+func (ck cacheKey) canonical() cacheKey {
+	ck.Name = canonicalName(ck.Name)
+	return ck
+}
+
+func getRRsetKey(rr parser.DNSResourceRecord) cacheKey {
+	return cacheKey{canonicalName(rr.Name), rr.Type, rr.Class}
+}
+
+// cacheEntry is the unit of eviction. It holds either a positive RRset or a
+// negative response, and sits in the LRU list of the cache.
+type cacheEntry struct {
+	key      cacheKey
+	negative bool
+	rrset    cachedRRset
+	neg      negativeCacheEntry
+	size     int
+	elem     *list.Element
+	// hits counts lookups served from the entry since it was added.
+	hits        int
+	prefetching bool
+}
+
+func (e *cacheEntry) expiry() time.Time {
+	if e.negative {
+		return e.neg.expiry
+	}
+	return e.rrset.expiry
+}
+
+// staleTTL is the TTL given to records served after they expired, as
+// recommended by RFC 8767.
+const staleTTL = 30
+
+// getRemainingTTL returns the whole seconds left before expiry, rounded up
+// so a record is never served with a TTL of zero before it expires.
+func getRemainingTTL(expiry time.Time, now time.Time) uint32 {
+	remaining := expiry.Sub(now)
+	if remaining <= 0 {
+		return 0
+	}
+	return uint32((remaining + time.Second - 1) / time.Second)
+}
+
+func setTTL(records []parser.DNSResourceRecord, ttl uint32) {
+	for i := range records {
+		records[i].TTL = ttl
+	}
+}
+
+// Record sizes are estimates of the memory held, not of the wire format.
+const entryOverhead = 64
+
+func getRecordSize(rr parser.DNSResourceRecord) int {
+	return entryOverhead + len(rr.Name) + len(rr.RData.String())
+}
+
+func getEntrySize(k cacheKey, rrs []parser.DNSResourceRecord) int {
+	size := entryOverhead + len(k.Name)
+	for _, rr := range rrs {
+		size += getRecordSize(rr)
+	}
+	return size
+}
+
+type CacheConfig struct {
+	// MaxEntries bounds the number of RRsets and negative entries held.
+	// Zero means no limit.
+	MaxEntries int
+	// MaxBytes bounds the estimated memory used by cached records. Zero
+	// means no limit.
+	MaxBytes int
+	// SweepInterval is how often expired entries are removed in the
+	// background. Zero disables the sweeper.
+	SweepInterval time.Duration
+	// PrefetchHits is the number of hits after which an RRset is refreshed
+	// before it expires. Zero disables prefetching.
+	PrefetchHits int
+	// PrefetchFraction is the fraction of its original TTL an RRset must
+	// have left for a prefetch to start.
+	PrefetchFraction float64
+	// StaleWindow is how long RRsets are kept after they expire so they can
+	// be served when resolution fails. Zero disables serve-stale.
+	StaleWindow time.Duration
+	// MinTTL and MaxTTL clamp the TTL, in seconds, that records are cached
+	// for. Zero leaves that side unclamped.
+	MinTTL uint32
+	MaxTTL uint32
+}
+
+func DefaultCacheConfig() CacheConfig {
+	return CacheConfig{
+		MaxEntries:       100000,
+		MaxBytes:         64 << 20,
+		SweepInterval:    time.Minute,
+		PrefetchHits:     10,
+		PrefetchFraction: 0.1,
+		MaxTTL:           86400,
+	}
+}
+
+// CacheStats describes the cache. Hits and Misses count resolver lookups
+// recorded with RecordLookup, not the individual keys each lookup reads.
+type CacheStats struct {
+	Entries     int
+	Bytes       int
+	Hits        uint64
+	Misses      uint64
+	Evictions   uint64
+	Expirations uint64
+	Prefetches  uint64
+	StaleHits   uint64
+}
+
 type cache struct {
-	records map[cacheKey][]cachedResourceRecord
-	logger  *zap.Logger
-	mu      sync.RWMutex
+	records   map[cacheKey]*cacheEntry
+	negatives map[cacheKey]*cacheEntry
+	lru       *list.List
+	config    CacheConfig
+	stats     CacheStats
+	stop      chan struct{}
+	closeOnce sync.Once
+	logger    *zap.Logger
+	mu        sync.Mutex
 }
 
-func (c *cache) ClearExpired(k cacheKey) {
-	c.mu.Lock()
-	c.logger.Debug("Cleaning up cache", zap.String("Key", k.String()))
-	records := getLiveCachedResourceRecords(c.records[k])
-	if len(records) > 0 {
-		c.records[k] = records
+// clampTTL bounds ttl by the configured minimum and maximum cache TTLs.
+func (c *cache) clampTTL(ttl uint32) uint32 {
+	if c.config.MinTTL > 0 {
+		ttl = max(ttl, c.config.MinTTL)
+	}
+	if c.config.MaxTTL > 0 {
+		ttl = min(ttl, c.config.MaxTTL)
+	}
+	return ttl
+}
+
+// isRemovable reports whether e has expired and is past the window in which
+// it may still be served stale.
+func (c *cache) isRemovable(e *cacheEntry, now time.Time) bool {
+	expiry := e.expiry()
+	if !e.negative {
+		expiry = expiry.Add(c.config.StaleWindow)
+	}
+	return !now.Before(expiry)
+}
+
+func (c *cache) removeEntry(e *cacheEntry) {
+	if e.negative {
+		delete(c.negatives, e.key)
 	} else {
-		delete(c.records, k)
+		delete(c.records, e.key)
 	}
-	c.mu.Unlock()
+	c.lru.Remove(e.elem)
+	c.stats.Bytes -= e.size
 }
 
-func getLiveCachedResourceRecords(crrs []cachedResourceRecord) []cachedResourceRecord {
-	result := make([]cachedResourceRecord, 0, len(crrs))
-	for _, crr := range crrs {
-		if time.Now().Before(crr.expiry) {
-			result = append(result, crr)
-		}
+func (c *cache) insertEntry(e *cacheEntry) {
+	entries := c.records
+	if e.negative {
+		entries = c.negatives
+	}
+	if old, ok := entries[e.key]; ok {
+		c.removeEntry(old)
 	}
-	return result
+	e.elem = c.lru.PushFront(e)
+	entries[e.key] = e
+	c.stats.Bytes += e.size
+	c.evict()
 }
 
-func getLiveResourceRecords(crrs []cachedResourceRecord) ([]parser.DNSResourceRecord, bool) {
-	hasExpired := false
-	result := make([]parser.DNSResourceRecord, 0, len(crrs))
-	for _, crr := range crrs {
-		if time.Now().Before(crr.expiry) {
-			result = append(result, crr.record)
-		} else {
-			hasExpired = true
-		}
+// evict drops the least recently used entries until the cache is back
+// within its configured bounds.
+func (c *cache) evict() {
+	for c.lru.Len() > 0 && (c.config.MaxEntries > 0 && c.lru.Len() > c.config.MaxEntries || c.config.MaxBytes > 0 && c.stats.Bytes > c.config.MaxBytes) {
+		e := c.lru.Back().Value.(*cacheEntry)
+		c.logger.Debug("Evicting from cache", zap.String("Key", e.key.String()))
+		c.removeEntry(e)
+		c.stats.Evictions++
 	}
-	return result, hasExpired
 }
 
+func (c *cache) ClearExpired(k cacheKey) {
+	c.mu.Lock()
+	e, ok := c.records[k]
+	if ok && c.isRemovable(e, time.Now()) {
+		c.logger.Debug("Cleaning up cache", zap.String("Key", k.String()))
+		c.removeEntry(e)
+		c.stats.Expirations++
+	}
+	c.mu.Unlock()
+}
+
+// Get returns the RRset cached for k, with each record's TTL set to the time
+// left before the set expires.
 func (c *cache) Get(k cacheKey) ([]parser.DNSResourceRecord, bool) {
-	c.mu.RLock()
-	crrs, ok := c.records[k]
-	c.mu.RUnlock()
+	k = k.canonical()
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.records[k]
 	if !ok {
 		return nil, false
 	}
-	result, hasExpired := getLiveResourceRecords(crrs)
-	if hasExpired {
+	if !now.Before(e.expiry()) {
 		go c.ClearExpired(k)
+		return nil, false
+	}
+	e.hits++
+	c.lru.MoveToFront(e.elem)
+	records := slices.Clone(e.rrset.records)
+	setTTL(records, getRemainingTTL(e.rrset.expiry, now))
+	return records, true
+}
+
+// GetStale returns the RRset for k if it has expired but is still within the
+// stale window. The records are returned with a TTL of staleTTL.
+func (c *cache) GetStale(k cacheKey) ([]parser.DNSResourceRecord, bool) {
+	if c.config.StaleWindow <= 0 {
+		return nil, false
+	}
+	k = k.canonical()
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.records[k]
+	if !ok || now.Before(e.expiry()) || c.isRemovable(e, now) {
+		return nil, false
+	}
+	c.stats.StaleHits++
+	c.lru.MoveToFront(e.elem)
+	records := slices.Clone(e.rrset.records)
+	setTTL(records, staleTTL)
+	return records, true
+}
+
+// groupRRsets splits rrs into RRsets keyed by owner name, type and class.
+func groupRRsets(rrs []parser.DNSResourceRecord) map[cacheKey][]parser.DNSResourceRecord {
+	sets := make(map[cacheKey][]parser.DNSResourceRecord)
+	for _, rr := range rrs {
+		k := getRRsetKey(rr)
+		sets[k] = append(sets[k], rr)
 	}
-	return result, len(result) > 0
+	return sets
 }
 
-func (c *cache) Add(domain string, v parser.DNSResourceRecord) {
+// Add caches rrs under their own owner names. Each RRset in rrs replaces any
+// set already cached for its key, and every record in it is given the
+// lowest TTL found in the set, clamped to the configured bounds.
+func (c *cache) Add(rrs []parser.DNSResourceRecord) {
+	sets := groupRRsets(rrs)
+	now := time.Now()
 	c.mu.Lock()
-	k := cacheKey{domain, v.Type, v.Class}
-	crrs, ok := c.records[k]
+	defer c.mu.Unlock()
+	for k, set := range sets {
+		ttl := set[0].TTL
+		for _, rr := range set {
+			ttl = min(ttl, rr.TTL)
+		}
+		ttl = c.clampTTL(ttl)
+		setTTL(set, ttl)
+		if neg, ok := c.negatives[k]; ok {
+			c.removeEntry(neg)
+		}
+		c.insertEntry(&cacheEntry{
+			key: k,
+			rrset: cachedRRset{
+				records: set,
+				expiry:  now.Add(time.Second * time.Duration(ttl)),
+				ttl:     time.Second * time.Duration(ttl),
+			},
+			size: getEntrySize(k, set),
+		})
+	}
+}
+
+// ShouldPrefetch reports whether the RRset for k is popular and close enough
+// to expiry to be refreshed. It returns true at most once per cached RRset,
+// so the caller is expected to start the refresh.
+func (c *cache) ShouldPrefetch(k cacheKey) bool {
+	if c.config.PrefetchHits <= 0 {
+		return false
+	}
+	k = k.canonical()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.records[k]
+	if !ok || e.prefetching || e.hits < c.config.PrefetchHits {
+		return false
+	}
+	remaining := time.Until(e.rrset.expiry)
+	if remaining <= 0 || remaining > time.Duration(float64(e.rrset.ttl)*c.config.PrefetchFraction) {
+		return false
+	}
+	e.prefetching = true
+	c.stats.Prefetches++
+	return true
+}
+
+func (c *cache) clearExpiredNegative(k cacheKey) {
+	c.mu.Lock()
+	e, ok := c.negatives[k]
+	if ok && !time.Now().Before(e.expiry()) {
+		c.logger.Debug("Cleaning up negative cache", zap.String("Key", k.String()))
+		c.removeEntry(e)
+		c.stats.Expirations++
+	}
+	c.mu.Unlock()
+}
+
+func (c *cache) GetNegative(k cacheKey) (negativeCacheEntry, bool) {
+	k = k.canonical()
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.negatives[k]
 	if !ok {
-		crrs = make([]cachedResourceRecord, 0, 1)
+		return negativeCacheEntry{}, false
+	}
+	if !now.Before(e.expiry()) {
+		go c.clearExpiredNegative(k)
+		return negativeCacheEntry{}, false
+	}
+	c.lru.MoveToFront(e.elem)
+	neg := e.neg
+	neg.soa.TTL = getRemainingTTL(neg.expiry, now)
+	return neg, true
+}
+
+// getNegativeSOA returns soa with its TTL lowered to its MINIMUM field, the
+// TTL a negative answer lives for as per RFC 2308.
+func getNegativeSOA(soa parser.DNSResourceRecord) parser.DNSResourceRecord {
+	if rd, ok := soa.RData.(parser.SOARecord); ok && rd.Minimum < soa.TTL {
+		soa.TTL = rd.Minimum
 	}
-	crrs = append(crrs, cachedResourceRecord{
-		record: v,
-		expiry: time.Now().Add(time.Second * time.Duration(v.TTL)),
+	return soa
+}
+
+// AddNegative caches an NXDOMAIN or NODATA response for k. The entry lives
+// for the TTL given by getNegativeSOA, and the SOA is served back with it.
+func (c *cache) AddNegative(k cacheKey, rcode parser.RCode, soa parser.DNSResourceRecord) {
+	k = k.canonical()
+	soa = getNegativeSOA(soa)
+	ttl := c.clampTTL(soa.TTL)
+	soa.TTL = ttl
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.insertEntry(&cacheEntry{
+		key:      k,
+		negative: true,
+		neg: negativeCacheEntry{
+			rcode:  rcode,
+			soa:    soa,
+			expiry: time.Now().Add(time.Second * time.Duration(ttl)),
+		},
+		size: getEntrySize(k, []parser.DNSResourceRecord{soa}),
 	})
-	c.records[k] = crrs
-	c.mu.Unlock()
 }
 
-func NewCache(logger *zap.Logger) *cache {
-	return &cache{
-		records: make(map[cacheKey][]cachedResourceRecord),
-		logger:  logger,
+// Sweep removes every expired entry from the cache.
+func (c *cache) Sweep() {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for elem := c.lru.Back(); elem != nil; {
+		e := elem.Value.(*cacheEntry)
+		elem = elem.Prev()
+		if c.isRemovable(e, now) {
+			c.removeEntry(e)
+			c.stats.Expirations++
+		}
+	}
+}
+
+func (c *cache) runSweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.Sweep()
+			stats := c.Stats()
+			c.logger.Debug("Swept cache", zap.Int("Entries", stats.Entries), zap.Int("Bytes", stats.Bytes), zap.Uint64("Evictions", stats.Evictions), zap.Uint64("Expirations", stats.Expirations))
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// RecordLookup counts a lookup that was answered from the cache, or that
+// missed it and has to be resolved.
+func (c *cache) RecordLookup(hit bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if hit {
+		c.stats.Hits++
+	} else {
+		c.stats.Misses++
+	}
+}
+
+func (c *cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	return stats
+}
+
+// Close stops the background sweeper. It is safe to call more than once.
+func (c *cache) Close() {
+	c.closeOnce.Do(func() {
+		close(c.stop)
+	})
+}
+
+func NewCache(logger *zap.Logger, config CacheConfig) *cache {
+	c := &cache{
+		records:   make(map[cacheKey]*cacheEntry),
+		negatives: make(map[cacheKey]*cacheEntry),
+		lru:       list.New(),
+		config:    config,
+		stop:      make(chan struct{}),
+		logger:    logger,
+	}
+	if config.SweepInterval > 0 {
+		go c.runSweeper(config.SweepInterval)
 	}
+	return c
 }
@@ -5,6 +5,8 @@ import (
 	"net"
 	"testing"
 	"time"
+
+	"go.uber.org/zap"
 )
 
 func makeARecord(name string, ttl uint32) parser.DNSResourceRecord {
@@ -18,12 +20,12 @@ func makeARecord(name string, ttl uint32) parser.DNSResourceRecord {
 }
 
 func TestCache_AddAndGet_NoExpiry(t *testing.T) {
-	c := NewCache()
+	c := NewCache(zap.NewNop(), CacheConfig{})
 	domain := "example.com."
 	key := cacheKey{Name: domain, Type: parser.RTA, Class: parser.RCIN}
 	record := makeARecord(domain, 60)
 
-	c.Add(domain, record)
+	c.Add([]parser.DNSResourceRecord{record})
 
 	got, ok := c.Get(key)
 	if !ok || len(got) != 1 {
@@ -36,12 +38,12 @@ func TestCache_AddAndGet_NoExpiry(t *testing.T) {
 }
 
 func TestCache_ExpiredRecordIsNotReturned(t *testing.T) {
-	c := NewCache()
+	c := NewCache(zap.NewNop(), CacheConfig{})
 	domain := "expired.com."
 	key := cacheKey{Name: domain, Type: parser.RTA, Class: parser.RCIN}
 	record := makeARecord(domain, 1)
 
-	c.Add(domain, record)
+	c.Add([]parser.DNSResourceRecord{record})
 
 	// Wait for expiry
 	time.Sleep(2 * time.Second)
@@ -53,15 +55,14 @@ func TestCache_ExpiredRecordIsNotReturned(t *testing.T) {
 }
 
 func TestCache_AddMultipleAndRetrieve(t *testing.T) {
-	c := NewCache()
+	c := NewCache(zap.NewNop(), CacheConfig{})
 	domain := "multi.com."
 	key := cacheKey{Name: domain, Type: parser.RTA, Class: parser.RCIN}
 
 	r1 := makeARecord(domain, 10)
 	r2 := makeARecord(domain, 10)
 
-	c.Add(domain, r1)
-	c.Add(domain, r2)
+	c.Add([]parser.DNSResourceRecord{r1, r2})
 
 	got, ok := c.Get(key)
 	if !ok || len(got) != 2 {
@@ -70,7 +71,7 @@ func TestCache_AddMultipleAndRetrieve(t *testing.T) {
 }
 
 func TestCache_ConcurrentAccess(t *testing.T) {
-	c := NewCache()
+	c := NewCache(zap.NewNop(), CacheConfig{})
 	domain := "concurrent.com."
 	rr := makeARecord(domain, 10)
 
@@ -78,7 +79,7 @@ func TestCache_ConcurrentAccess(t *testing.T) {
 
 	for i := 0; i < goroutines; i++ {
 		go func() {
-			c.Add(domain, rr)
+			c.Add([]parser.DNSResourceRecord{rr})
 		}()
 		go func() {
 			c.Get(cacheKey{rr.Name, rr.Type, rr.Class})
@@ -93,38 +94,353 @@ func TestCache_ConcurrentAccess(t *testing.T) {
 	}
 }
 
-func TestCache_ClearExpiredCleansUp(t *testing.T) {
-	c := NewCache()
+func TestCache_RRsetSharesLowestTTL(t *testing.T) {
+	c := NewCache(zap.NewNop(), CacheConfig{})
 	domain := "cleanup.com."
-	valid := makeARecord(domain, 5)
-	expired := makeARecord(domain, 1)
+	long := makeARecord(domain, 5)
+	short := makeARecord(domain, 1)
+
+	c.Add([]parser.DNSResourceRecord{long, short})
 
-	c.Add(domain, valid)
-	c.Add(domain, expired)
+	records, ok := c.Get(cacheKey{domain, long.Type, long.Class})
+	if !ok || len(records) != 2 {
+		t.Fatalf("expected 2 records, got %v", records)
+	}
+	for _, rr := range records {
+		if rr.TTL != 1 {
+			t.Errorf("expected TTL 1 for every record in the set, got %d", rr.TTL)
+		}
+	}
 
 	time.Sleep(2 * time.Second)
 
-	records, ok := c.Get(cacheKey{domain, valid.Type, valid.Class})
-	if !ok || len(records) != 1 {
-		t.Fatalf("expected 1 live record, got %v", records)
+	records, ok = c.Get(cacheKey{domain, long.Type, long.Class})
+	if ok || len(records) != 0 {
+		t.Fatalf("expected whole RRset to expire, got %v", records)
 	}
 
 	time.Sleep(100 * time.Millisecond)
 
 	internal := c.GetInternal()
-	key := cacheKey{Name: domain, Type: valid.Type, Class: valid.Class}
-	cached := internal[key]
-	if len(cached) != 1 {
-		t.Errorf("expected 1 cached record after cleanup, got %d", len(cached))
+	key := cacheKey{Name: domain, Type: long.Type, Class: long.Class}
+	if _, ok := internal[key]; ok {
+		t.Errorf("expected expired RRset to be cleaned up")
+	}
+}
+
+func TestCache_AddReplacesRRset(t *testing.T) {
+	c := NewCache(zap.NewNop(), CacheConfig{})
+	domain := "replace.com."
+	key := cacheKey{Name: domain, Type: parser.RTA, Class: parser.RCIN}
+
+	c.Add([]parser.DNSResourceRecord{makeARecord(domain, 60), makeARecord(domain, 60)})
+	c.Add([]parser.DNSResourceRecord{makeARecord(domain, 30)})
+
+	got, ok := c.Get(key)
+	if !ok || len(got) != 1 {
+		t.Fatalf("expected replacement RRset of 1 record, got %v", got)
+	}
+	if got[0].TTL != 30 {
+		t.Errorf("expected TTL 30, got %d", got[0].TTL)
 	}
 }
 
-func (c *cache) GetInternal() map[cacheKey][]cachedResourceRecord {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	cp := make(map[cacheKey][]cachedResourceRecord, len(c.records))
+func TestCache_IndexesByOwnerName(t *testing.T) {
+	c := NewCache(zap.NewNop(), CacheConfig{})
+
+	c.Add([]parser.DNSResourceRecord{
+		makeNSRecord("example.com.", "ns1.example.com."),
+		makeARecord("ns1.example.com.", 60),
+		makeARecord("NS2.Example.COM.", 60),
+	})
+
+	if got, ok := c.Get(cacheKey{"example.com.", parser.RTNS, parser.RCIN}); !ok || len(got) != 1 {
+		t.Errorf("expected NS record under zone name, got %v", got)
+	}
+	if got, ok := c.Get(cacheKey{"ns1.example.com.", parser.RTA, parser.RCIN}); !ok || len(got) != 1 {
+		t.Errorf("expected glue under nameserver name, got %v", got)
+	}
+	if got, ok := c.Get(cacheKey{"ns2.example.com.", parser.RTA, parser.RCIN}); !ok || len(got) != 1 {
+		t.Errorf("expected owner names to be case-insensitive, got %v", got)
+	}
+	if got, ok := c.Get(cacheKey{"example.com.", parser.RTA, parser.RCIN}); ok {
+		t.Errorf("expected no A record for zone name, got %v", got)
+	}
+}
+
+func (c *cache) GetInternal() map[cacheKey]cachedRRset {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cp := make(map[cacheKey]cachedRRset, len(c.records))
 	for k, v := range c.records {
-		cp[k] = append([]cachedResourceRecord(nil), v...)
+		cp[k] = cachedRRset{records: append([]parser.DNSResourceRecord(nil), v.rrset.records...), expiry: v.rrset.expiry}
 	}
 	return cp
 }
+
+func makeSOARecord(name string, ttl uint32, minimum uint32) parser.DNSResourceRecord {
+	return parser.DNSResourceRecord{
+		Name:  name,
+		Type:  parser.RTSOA,
+		Class: parser.RCIN,
+		TTL:   ttl,
+		RData: parser.SOARecord{
+			MName:   "ns1." + name,
+			RName:   "hostmaster." + name,
+			Serial:  1,
+			Refresh: 3600,
+			Retry:   600,
+			Expire:  86400,
+			Minimum: minimum,
+		},
+	}
+}
+
+func TestCache_NegativeEntryUsesSOAMinimum(t *testing.T) {
+	c := NewCache(zap.NewNop(), CacheConfig{})
+	key := cacheKey{Name: "missing.example.com.", Type: parser.RTA, Class: parser.RCIN}
+
+	c.AddNegative(key, parser.NXDomain, makeSOARecord("example.com.", 3600, 300))
+
+	entry, ok := c.GetNegative(key)
+	if !ok {
+		t.Fatal("expected negative entry to be cached")
+	}
+	if entry.rcode != parser.NXDomain {
+		t.Errorf("expected rcode NXDOMAIN, got %v", entry.rcode)
+	}
+	if entry.soa.TTL != 300 {
+		t.Errorf("expected SOA TTL 300, got %d", entry.soa.TTL)
+	}
+}
+
+func TestCache_NegativeEntryExpires(t *testing.T) {
+	c := NewCache(zap.NewNop(), CacheConfig{})
+	key := cacheKey{Name: "nodata.example.com.", Type: parser.RTMX, Class: parser.RCIN}
+
+	c.AddNegative(key, parser.NoError, makeSOARecord("example.com.", 1, 3600))
+
+	time.Sleep(2 * time.Second)
+
+	if _, ok := c.GetNegative(key); ok {
+		t.Fatal("expected expired negative entry to be purged")
+	}
+}
+
+func TestCache_LookupsDoNotCount(t *testing.T) {
+	c := NewCache(zap.NewNop(), CacheConfig{})
+	key := cacheKey{Name: "missing.example.com.", Type: parser.RTA, Class: parser.RCIN}
+
+	c.Get(key)
+	c.GetNegative(key)
+	c.AddNegative(key, parser.NXDomain, makeSOARecord("example.com.", 3600, 300))
+	c.GetNegative(key)
+	c.RecordLookup(true)
+	c.RecordLookup(false)
+
+	if stats := c.Stats(); stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("expected only recorded lookups to count, got %+v", stats)
+	}
+}
+
+func TestCache_CloseTwice(t *testing.T) {
+	c := NewCache(zap.NewNop(), CacheConfig{SweepInterval: time.Minute})
+	c.Close()
+	c.Close()
+}
+
+func TestCache_PositiveAddReplacesNegative(t *testing.T) {
+	c := NewCache(zap.NewNop(), CacheConfig{})
+	domain := "flip.example.com."
+	key := cacheKey{Name: domain, Type: parser.RTA, Class: parser.RCIN}
+
+	c.AddNegative(key, parser.NXDomain, makeSOARecord("example.com.", 60, 60))
+	c.Add([]parser.DNSResourceRecord{makeARecord(domain, 60)})
+
+	if _, ok := c.GetNegative(key); ok {
+		t.Error("expected negative entry to be removed by positive answer")
+	}
+}
+
+func TestCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewCache(zap.NewNop(), CacheConfig{MaxEntries: 2})
+	keyA := cacheKey{Name: "a.example.com.", Type: parser.RTA, Class: parser.RCIN}
+	keyB := cacheKey{Name: "b.example.com.", Type: parser.RTA, Class: parser.RCIN}
+	keyC := cacheKey{Name: "c.example.com.", Type: parser.RTA, Class: parser.RCIN}
+
+	c.Add([]parser.DNSResourceRecord{makeARecord(keyA.Name, 60)})
+	c.Add([]parser.DNSResourceRecord{makeARecord(keyB.Name, 60)})
+	c.Get(keyA)
+	c.Add([]parser.DNSResourceRecord{makeARecord(keyC.Name, 60)})
+
+	if _, ok := c.Get(keyB); ok {
+		t.Error("expected least recently used entry to be evicted")
+	}
+	for _, k := range []cacheKey{keyA, keyC} {
+		if _, ok := c.Get(k); !ok {
+			t.Errorf("expected %v to remain cached", k)
+		}
+	}
+	if stats := c.Stats(); stats.Evictions != 1 || stats.Entries != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestCache_EvictsOverByteLimit(t *testing.T) {
+	record := makeARecord("a.example.com.", 60)
+	size := getEntrySize(getRRsetKey(record), []parser.DNSResourceRecord{record})
+	c := NewCache(zap.NewNop(), CacheConfig{MaxBytes: size*2 + size/2})
+
+	for _, name := range []string{"a.example.com.", "b.example.com.", "c.example.com."} {
+		c.Add([]parser.DNSResourceRecord{makeARecord(name, 60)})
+	}
+
+	stats := c.Stats()
+	if stats.Entries != 2 || stats.Bytes > size*2+size/2 {
+		t.Errorf("expected cache to stay within byte limit, got %+v", stats)
+	}
+}
+
+func TestCache_SweepRemovesExpired(t *testing.T) {
+	c := NewCache(zap.NewNop(), CacheConfig{})
+	c.Add([]parser.DNSResourceRecord{makeARecord("short.example.com.", 1)})
+	c.Add([]parser.DNSResourceRecord{makeARecord("long.example.com.", 60)})
+	c.AddNegative(cacheKey{Name: "gone.example.com.", Type: parser.RTA, Class: parser.RCIN}, parser.NXDomain, makeSOARecord("example.com.", 1, 1))
+
+	time.Sleep(1100 * time.Millisecond)
+	c.Sweep()
+
+	stats := c.Stats()
+	if stats.Entries != 1 || stats.Expirations != 2 {
+		t.Errorf("unexpected stats after sweep %+v", stats)
+	}
+	if len(c.GetInternal()) != 1 {
+		t.Errorf("expected only the unexpired RRset to remain")
+	}
+}
+
+func TestCache_ShouldPrefetch(t *testing.T) {
+	c := NewCache(zap.NewNop(), CacheConfig{PrefetchHits: 2, PrefetchFraction: 0.9})
+	domain := "hot.example.com."
+	key := cacheKey{Name: domain, Type: parser.RTA, Class: parser.RCIN}
+
+	c.Add([]parser.DNSResourceRecord{makeARecord(domain, 1)})
+	c.Get(key)
+	c.Get(key)
+	if c.ShouldPrefetch(key) {
+		t.Fatal("expected no prefetch while most of the TTL remains")
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if !c.ShouldPrefetch(key) {
+		t.Fatal("expected prefetch for popular entry near expiry")
+	}
+	if c.ShouldPrefetch(key) {
+		t.Error("expected prefetch to be started only once")
+	}
+
+	cold := cacheKey{Name: "cold.example.com.", Type: parser.RTA, Class: parser.RCIN}
+	c.Add([]parser.DNSResourceRecord{makeARecord(cold.Name, 1)})
+	c.Get(cold)
+	time.Sleep(200 * time.Millisecond)
+	if c.ShouldPrefetch(cold) {
+		t.Error("expected no prefetch for entry below the hit threshold")
+	}
+	if stats := c.Stats(); stats.Prefetches != 1 {
+		t.Errorf("expected 1 prefetch, got %d", stats.Prefetches)
+	}
+}
+
+func TestCache_GetStale(t *testing.T) {
+	tests := []struct {
+		name        string
+		staleWindow time.Duration
+		wantStale   bool
+	}{
+		{"disabled", 0, false},
+		{"within window", time.Minute, true},
+		{"past window", 500 * time.Millisecond, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCache(zap.NewNop(), CacheConfig{StaleWindow: tt.staleWindow})
+			domain := "stale.example.com."
+			key := cacheKey{Name: domain, Type: parser.RTA, Class: parser.RCIN}
+			c.Add([]parser.DNSResourceRecord{makeARecord(domain, 1)})
+
+			if _, ok := c.GetStale(key); ok {
+				t.Fatal("expected unexpired entry not to be served stale")
+			}
+			time.Sleep(1600 * time.Millisecond)
+			if _, ok := c.Get(key); ok {
+				t.Fatal("expected expired entry to miss")
+			}
+
+			got, ok := c.GetStale(key)
+			if ok != tt.wantStale {
+				t.Fatalf("expected stale=%v, got %v", tt.wantStale, ok)
+			}
+			if ok && (len(got) != 1 || got[0].TTL != staleTTL) {
+				t.Errorf("expected one record with TTL %d, got %v", staleTTL, got)
+			}
+			if ok && c.Stats().StaleHits != 1 {
+				t.Errorf("expected stale hit to be counted")
+			}
+		})
+	}
+}
+
+func TestCache_GetDecrementsTTL(t *testing.T) {
+	c := NewCache(zap.NewNop(), CacheConfig{})
+	domain := "ttl.example.com."
+	key := cacheKey{Name: domain, Type: parser.RTA, Class: parser.RCIN}
+	negKey := cacheKey{Name: domain, Type: parser.RTMX, Class: parser.RCIN}
+
+	c.Add([]parser.DNSResourceRecord{makeARecord(domain, 3)})
+	c.AddNegative(negKey, parser.NoError, makeSOARecord("example.com.", 3, 3))
+	time.Sleep(1100 * time.Millisecond)
+
+	got, ok := c.Get(key)
+	if !ok || got[0].TTL != 2 {
+		t.Errorf("expected remaining TTL 2, got %v", got)
+	}
+	entry, ok := c.GetNegative(negKey)
+	if !ok || entry.soa.TTL != 2 {
+		t.Errorf("expected remaining SOA TTL 2, got %v", entry.soa)
+	}
+}
+
+func TestCache_ClampsTTL(t *testing.T) {
+	tests := []struct {
+		name    string
+		ttl     uint32
+		minimum uint32
+		maximum uint32
+		want    uint32
+	}{
+		{"unclamped", 300, 0, 0, 300},
+		{"raised to minimum", 5, 60, 0, 60},
+		{"lowered to maximum", 604800, 0, 86400, 86400},
+		{"within bounds", 300, 60, 86400, 300},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCache(zap.NewNop(), CacheConfig{MinTTL: tt.minimum, MaxTTL: tt.maximum})
+			domain := "clamp.example.com."
+			key := cacheKey{Name: domain, Type: parser.RTA, Class: parser.RCIN}
+			negKey := cacheKey{Name: domain, Type: parser.RTMX, Class: parser.RCIN}
+
+			c.Add([]parser.DNSResourceRecord{makeARecord(domain, tt.ttl)})
+			c.AddNegative(negKey, parser.NoError, makeSOARecord("example.com.", tt.ttl, tt.ttl))
+
+			if got, ok := c.Get(key); !ok || got[0].TTL != tt.want {
+				t.Errorf("expected TTL %d, got %v", tt.want, got)
+			}
+			if entry, ok := c.GetNegative(negKey); !ok || entry.soa.TTL != tt.want {
+				t.Errorf("expected negative TTL %d, got %v", tt.want, entry.soa)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package resolver
+
+import (
+	"dns/internal/zone"
+	"net"
+	"time"
+)
+
+type Config struct {
+	// Timeout bounds each query sent to a nameserver. When zero, queries are
+	// only bounded by the caller's context.
+	Timeout time.Duration
+	// Retries is the number of times a nameserver that timed out is asked
+	// again before failing over to the next one.
+	Retries int
+	// Cache bounds the size of the resolver cache.
+	Cache CacheConfig
+	// RootHints is the path of a named.root style hints file. When empty,
+	// or the file cannot be read, built-in hints are used.
+	RootHints string
+	// PrimeInterval is how often the root server set is refreshed with a
+	// priming query. Zero disables priming.
+	PrimeInterval time.Duration
+	// Forwarders are upstream resolvers every query is sent to instead of
+	// being resolved from the root. Iteration is used when empty.
+	Forwarders []net.IP
+	// Rules forward queries for, or set the authoritative servers of,
+	// particular zones. They take precedence over Forwarders.
+	Rules []Rule
+	// Zones are answered authoritatively from their own data, ahead of
+	// rules, the cache and recursion. This holds for client queries as well
+	// as for aliases and nameserver names looked up while resolving. Names
+	// delegated away from a zone are resolved starting at its zone cut.
+	Zones []*zone.Zone
+	// LocalData pins names to local answers. It takes precedence over
+	// everything else, zones included. It may be nil.
+	LocalData *LocalData
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Timeout:       2 * time.Second,
+		Retries:       1,
+		Cache:         DefaultCacheConfig(),
+		PrimeInterval: 12 * time.Hour,
+	}
+}
@@ -0,0 +1,118 @@
+package resolver
+
+import (
+	"context"
+	"dns/internal/parser"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// call is a resolution in progress that concurrent lookups for the same key
+// wait on instead of starting their own.
+type call struct {
+	done chan struct{}
+	res  result
+	err  error
+	// waiting is the call the goroutine running this one is blocked on. It
+	// is used to detect lookups that would end up waiting on themselves.
+	waiting *call
+}
+
+// flightChain lists the calls led by one goroutine, innermost first. It is
+// carried in the context passed to the function run for a call.
+type flightChain struct {
+	call   *call
+	parent *flightChain
+}
+
+type flightChainKey struct{}
+
+func getFlightChain(ctx context.Context) *flightChain {
+	chain, _ := ctx.Value(flightChainKey{}).(*flightChain)
+	return chain
+}
+
+func (fc *flightChain) contains(c *call) bool {
+	for ; fc != nil; fc = fc.parent {
+		if fc.call == c {
+			return true
+		}
+	}
+	return false
+}
+
+func (fc *flightChain) setWaiting(c *call) {
+	for ; fc != nil; fc = fc.parent {
+		fc.call.waiting = c
+	}
+}
+
+type flightGroup struct {
+	calls map[cacheKey]*call
+	mu    sync.Mutex
+}
+
+// isLoop reports whether waiting on c would block on a call led by chain.
+func (g *flightGroup) isLoop(chain *flightChain, c *call) bool {
+	for ; c != nil; c = c.waiting {
+		if chain.contains(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// Do runs fn for k, unless a call for k is already in progress, in which case
+// it waits for that call and returns its result. If the call it waited on
+// was canceled by its own caller, Do tries again.
+func (g *flightGroup) Do(ctx context.Context, k cacheKey, fn func(context.Context) (result, error)) (result, error) {
+	chain := getFlightChain(ctx)
+	for {
+		g.mu.Lock()
+		c, ok := g.calls[k]
+		if !ok {
+			break
+		}
+		if g.isLoop(chain, c) {
+			g.mu.Unlock()
+			return result{}, parser.ServFailError{Err: fmt.Errorf("Resolution loop for %v", k)}
+		}
+		chain.setWaiting(c)
+		g.mu.Unlock()
+
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+		}
+		g.mu.Lock()
+		chain.setWaiting(nil)
+		g.mu.Unlock()
+		if ctx.Err() != nil {
+			return result{}, canceledError(ctx.Err())
+		}
+		if errors.Is(c.err, ErrCanceled) {
+			continue
+		}
+		return result{
+			answers:     slices.Clone(c.res.answers),
+			authorities: slices.Clone(c.res.authorities),
+			rcode:       c.res.rcode,
+		}, c.err
+	}
+	c := &call{done: make(chan struct{})}
+	g.calls[k] = c
+	g.mu.Unlock()
+
+	c.res, c.err = fn(context.WithValue(ctx, flightChainKey{}, &flightChain{c, chain}))
+	g.mu.Lock()
+	delete(g.calls, k)
+	g.mu.Unlock()
+	close(c.done)
+	return c.res, c.err
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: make(map[cacheKey]*call)}
+}
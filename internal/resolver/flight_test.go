@@ -0,0 +1,144 @@
+package resolver
+
+import (
+	"context"
+	"dns/internal/parser"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlightGroup_CoalescesConcurrentCalls(t *testing.T) {
+	g := newFlightGroup()
+	key := cacheKey{Name: "example.com.", Type: parser.RTA, Class: parser.RCIN}
+	var calls atomic.Int32
+	release := make(chan struct{})
+
+	var wg sync.WaitGroup
+	results := make([]result, 10)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], _ = g.Do(context.Background(), key, func(ctx context.Context) (result, error) {
+				calls.Add(1)
+				<-release
+				return result{answers: []parser.DNSResourceRecord{makeARecord(key.Name, 60)}}, nil
+			})
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("expected 1 resolution, got %d", n)
+	}
+	for i, res := range results {
+		if len(res.answers) != 1 {
+			t.Errorf("caller %d: expected shared answer, got %v", i, res.answers)
+		}
+	}
+}
+
+func TestFlightGroup_DetectsLoops(t *testing.T) {
+	g := newFlightGroup()
+	keyA := cacheKey{Name: "ns.a.example.", Type: parser.RTA, Class: parser.RCIN}
+	keyB := cacheKey{Name: "ns.b.example.", Type: parser.RTA, Class: parser.RCIN}
+
+	t.Run("same goroutine", func(t *testing.T) {
+		_, err := g.Do(context.Background(), keyA, func(ctx context.Context) (result, error) {
+			return g.Do(ctx, keyA, func(ctx context.Context) (result, error) {
+				t.Fatal("expected nested lookup not to run")
+				return result{}, nil
+			})
+		})
+		var sf parser.ServFailError
+		if !errors.As(err, &sf) {
+			t.Errorf("expected ServFailError, got %v", err)
+		}
+	})
+
+	t.Run("across goroutines", func(t *testing.T) {
+		startedA := make(chan struct{})
+		startedB := make(chan struct{})
+		errs := make(chan error, 2)
+		go func() {
+			_, err := g.Do(context.Background(), keyA, func(ctx context.Context) (result, error) {
+				close(startedA)
+				<-startedB
+				return g.Do(ctx, keyB, func(ctx context.Context) (result, error) { return result{}, nil })
+			})
+			errs <- err
+		}()
+		go func() {
+			_, err := g.Do(context.Background(), keyB, func(ctx context.Context) (result, error) {
+				close(startedB)
+				<-startedA
+				time.Sleep(50 * time.Millisecond)
+				return g.Do(ctx, keyA, func(ctx context.Context) (result, error) { return result{}, nil })
+			})
+			errs <- err
+		}()
+
+		for range 2 {
+			select {
+			case err := <-errs:
+				var sf parser.ServFailError
+				if !errors.As(err, &sf) {
+					t.Errorf("expected ServFailError, got %v", err)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("lookups deadlocked")
+			}
+		}
+	})
+}
+
+func TestFlightGroup_WaiterCanceled(t *testing.T) {
+	g := newFlightGroup()
+	key := cacheKey{Name: "slow.example.com.", Type: parser.RTA, Class: parser.RCIN}
+	release := make(chan struct{})
+	defer close(release)
+	go g.Do(context.Background(), key, func(ctx context.Context) (result, error) {
+		<-release
+		return result{}, nil
+	})
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := g.Do(ctx, key, func(ctx context.Context) (result, error) {
+		t.Fatal("expected waiter not to start its own lookup")
+		return result{}, nil
+	})
+	if !errors.Is(err, ErrCanceled) {
+		t.Errorf("expected ErrCanceled, got %v", err)
+	}
+}
+
+func TestFlightGroup_RetriesAfterLeaderCanceled(t *testing.T) {
+	g := newFlightGroup()
+	key := cacheKey{Name: "retry.example.com.", Type: parser.RTA, Class: parser.RCIN}
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	go g.Do(leaderCtx, key, func(ctx context.Context) (result, error) {
+		close(started)
+		<-ctx.Done()
+		return result{}, canceledError(ctx.Err())
+	})
+	<-started
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	res, err := g.Do(context.Background(), key, func(ctx context.Context) (result, error) {
+		return result{rcode: parser.NXDomain}, nil
+	})
+	if err != nil || res.rcode != parser.NXDomain {
+		t.Errorf("expected waiter to run its own lookup, got %v, %v", res, err)
+	}
+}
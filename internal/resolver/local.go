@@ -0,0 +1,201 @@
+package resolver
+
+import (
+	"bufio"
+	"dns/internal/parser"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// LocalData holds names pinned locally, which are answered before zones, the
+// cache or any upstream are consulted. A name with local data only has the records
+// given for it, so queries for other types get an empty answer.
+type LocalData struct {
+	records  map[cacheKey][]parser.DNSResourceRecord
+	names    map[string]bool
+	nxdomain map[string]bool
+	ttl      uint32
+}
+
+// getReverseName returns the in-addr.arpa or ip6.arpa name for ip.
+func getReverseName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa.", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	var sb strings.Builder
+	ip16 := ip.To16()
+	for i := len(ip16) - 1; i >= 0; i-- {
+		fmt.Fprintf(&sb, "%x.%x.", ip16[i]&0x0F, ip16[i]>>4)
+	}
+	sb.WriteString("ip6.arpa.")
+	return sb.String()
+}
+
+// add adds rr to its RRset. Records of an RRset share one TTL (RFC 2181
+// section 5.2), so the TTL of the last entry added applies to the whole set.
+func (ld *LocalData) add(rr parser.DNSResourceRecord) {
+	k := getRRsetKey(rr)
+	set := ld.records[k]
+	if !slices.ContainsFunc(set, func(old parser.DNSResourceRecord) bool {
+		return old.RData.String() == rr.RData.String()
+	}) {
+		set = append(set, rr)
+	}
+	setTTL(set, rr.TTL)
+	ld.records[k] = set
+	ld.names[k.Name] = true
+}
+
+// AddAddress pins name to ip, adding the matching PTR record for ip.
+func (ld *LocalData) AddAddress(name string, ip net.IP, ttl uint32) {
+	name = canonicalName(name)
+	rr := parser.DNSResourceRecord{Name: name, Class: parser.RCIN, TTL: ttl}
+	if ip4 := ip.To4(); ip4 != nil {
+		rr.Type, rr.RData = parser.RTA, parser.ARecord{IP: ip4}
+	} else {
+		rr.Type, rr.RData = parser.RTAAAA, parser.AAAARecord{IP: ip}
+	}
+	ld.add(rr)
+	ld.add(parser.DNSResourceRecord{
+		Name:  getReverseName(ip),
+		Type:  parser.RTPTR,
+		Class: parser.RCIN,
+		TTL:   ttl,
+		RData: parser.PTRRecord{Name: name},
+	})
+}
+
+// AddNXDomain makes queries for name fail with NXDOMAIN.
+func (ld *LocalData) AddNXDomain(name string) {
+	ld.nxdomain[canonicalName(name)] = true
+}
+
+// ParseHosts reads entries in the format of /etc/hosts, an address followed
+// by the names it is pinned to, from r.
+func (ld *LocalData) ParseHosts(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || len(fields) < 2 {
+			return fmt.Errorf("Invalid hosts entry on line %d", line)
+		}
+		for _, name := range fields[1:] {
+			ld.AddAddress(name, ip, ld.ttl)
+		}
+	}
+	return scanner.Err()
+}
+
+// ParseOverrides reads overrides from r, one per line in the form
+//
+//	name [ttl] A|AAAA address
+//	name NXDOMAIN
+//
+// Entries without a TTL use the default TTL of the local data.
+func (ld *LocalData) ParseOverrides(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) == 2 && strings.EqualFold(fields[1], "NXDOMAIN") {
+			ld.AddNXDomain(fields[0])
+			continue
+		}
+		ttl := ld.ttl
+		if len(fields) == 4 {
+			n, err := strconv.ParseUint(fields[1], 10, 32)
+			if err != nil {
+				return fmt.Errorf("Invalid TTL %q on line %d", fields[1], line)
+			}
+			ttl = uint32(n)
+			fields = append(fields[:1], fields[2:]...)
+		}
+		if len(fields) != 3 {
+			return fmt.Errorf("Invalid override on line %d", line)
+		}
+		ip := net.ParseIP(fields[2])
+		switch strings.ToUpper(fields[1]) {
+		case "A":
+			if ip == nil || ip.To4() == nil {
+				return fmt.Errorf("Invalid IPv4 address %q on line %d", fields[2], line)
+			}
+		case "AAAA":
+			if ip == nil || ip.To4() != nil {
+				return fmt.Errorf("Invalid IPv6 address %q on line %d", fields[2], line)
+			}
+		default:
+			return fmt.Errorf("Unsupported record type %q on line %d", fields[1], line)
+		}
+		ld.AddAddress(fields[0], ip, ttl)
+	}
+	return scanner.Err()
+}
+
+func loadFile(path string, parse func(io.Reader) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := parse(f); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// LoadHosts adds the entries of the hosts file at path.
+func (ld *LocalData) LoadHosts(path string) error {
+	return loadFile(path, ld.ParseHosts)
+}
+
+// LoadOverrides adds the entries of the override file at path.
+func (ld *LocalData) LoadOverrides(path string) error {
+	return loadFile(path, ld.ParseOverrides)
+}
+
+// lookup answers a query from local data, reporting whether the name is
+// pinned locally at all.
+func (ld *LocalData) lookup(domain string, qtype parser.RecordType, qclass parser.RecordClass) (result, bool) {
+	if ld == nil || qclass != parser.RCIN {
+		return result{}, false
+	}
+	name := canonicalName(domain)
+	if ld.nxdomain[name] {
+		return result{rcode: parser.NXDomain}, true
+	}
+	if !ld.names[name] {
+		return result{}, false
+	}
+	if qtype == parser.RTSTAR {
+		answers := make([]parser.DNSResourceRecord, 0)
+		for _, rt := range []parser.RecordType{parser.RTA, parser.RTAAAA, parser.RTPTR} {
+			answers = append(answers, ld.records[cacheKey{name, rt, qclass}]...)
+		}
+		return result{answers: answers}, true
+	}
+	return result{answers: slices.Clone(ld.records[cacheKey{name, qtype, qclass}])}, true
+}
+
+// NewLocalData creates empty local data whose entries are served with ttl
+// unless they give their own.
+func NewLocalData(ttl uint32) *LocalData {
+	return &LocalData{
+		records:  make(map[cacheKey][]parser.DNSResourceRecord),
+		names:    make(map[string]bool),
+		nxdomain: make(map[string]bool),
+		ttl:      ttl,
+	}
+}
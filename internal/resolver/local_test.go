@@ -0,0 +1,155 @@
+package resolver
+
+import (
+	"dns/internal/parser"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestGetReverseName(t *testing.T) {
+	tests := []struct {
+		ip     string
+		expect string
+	}{
+		{"192.0.2.1", "1.2.0.192.in-addr.arpa."},
+		{"2001:db8::567:89ab", "b.a.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := getReverseName(net.ParseIP(tt.ip)); got != tt.expect {
+				t.Errorf("expected %s, got %s", tt.expect, got)
+			}
+		})
+	}
+}
+
+func TestLocalData_Lookup(t *testing.T) {
+	ld := NewLocalData(300)
+	hosts := "# fixtures\n127.0.0.1 localhost\n192.0.2.10 web.test www.web.test # alias\n2001:db8::10 web.test\n"
+	if err := ld.ParseHosts(strings.NewReader(hosts)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	overrides := "ads.example.com NXDOMAIN\napi.test 60 A 192.0.2.20\n"
+	if err := ld.ParseOverrides(strings.NewReader(overrides)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		domain      string
+		qtype       parser.RecordType
+		expectOK    bool
+		expectRCode parser.RCode
+		expectData  []string
+		expectTTL   uint32
+	}{
+		{"A", "WEB.test.", parser.RTA, true, parser.NoError, []string{"192.0.2.10"}, 300},
+		{"AAAA", "web.test", parser.RTAAAA, true, parser.NoError, []string{"2001:db8::10"}, 300},
+		{"alias", "www.web.test.", parser.RTA, true, parser.NoError, []string{"192.0.2.10"}, 300},
+		{"no data", "web.test.", parser.RTMX, true, parser.NoError, nil, 0},
+		{"PTR", "10.2.0.192.in-addr.arpa.", parser.RTPTR, true, parser.NoError, []string{"web.test.", "www.web.test."}, 300},
+		{"override TTL", "api.test.", parser.RTA, true, parser.NoError, []string{"192.0.2.20"}, 60},
+		{"NXDOMAIN", "ads.example.com.", parser.RTA, true, parser.NXDomain, nil, 0},
+		{"unlisted", "example.com.", parser.RTA, false, parser.NoError, nil, 0},
+		{"subdomain", "sub.web.test.", parser.RTA, false, parser.NoError, nil, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, ok := ld.lookup(tt.domain, tt.qtype, parser.RCIN)
+			if ok != tt.expectOK {
+				t.Fatalf("expected ok %v, got %v", tt.expectOK, ok)
+			}
+			if res.rcode != tt.expectRCode {
+				t.Errorf("expected %v, got %v", tt.expectRCode, res.rcode)
+			}
+			if len(res.answers) != len(tt.expectData) {
+				t.Fatalf("expected %d answers, got %v", len(tt.expectData), res.answers)
+			}
+			for i, rr := range res.answers {
+				if rr.RData.String() != tt.expectData[i] || rr.TTL != tt.expectTTL {
+					t.Errorf("expected %s with TTL %d, got %v", tt.expectData[i], tt.expectTTL, rr)
+				}
+			}
+		})
+	}
+
+	if _, ok := ld.lookup("web.test.", parser.RTA, parser.RCCH); ok {
+		t.Error("expected local data to only answer class IN")
+	}
+}
+
+func TestLocalData_RRsetSharesTTL(t *testing.T) {
+	ld := NewLocalData(300)
+	if err := ld.ParseHosts(strings.NewReader("192.0.2.10 web.test\n192.0.2.11 web.test\n")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ld.ParseOverrides(strings.NewReader("web.test 60 A 192.0.2.10\n")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	res, _ := ld.lookup("web.test.", parser.RTA, parser.RCIN)
+	if len(res.answers) != 2 {
+		t.Fatalf("expected 2 answers, got %v", res.answers)
+	}
+	for _, rr := range res.answers {
+		if rr.TTL != 60 {
+			t.Errorf("expected the last TTL given to apply to the whole RRset, got %v", rr)
+		}
+	}
+}
+
+func TestLocalData_ParseErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		hosts bool
+		input string
+	}{
+		{"hosts bad address", true, "192.0.2 web.test\n"},
+		{"hosts missing name", true, "192.0.2.1\n"},
+		{"override bad TTL", false, "web.test soon A 192.0.2.1\n"},
+		{"override A with IPv6", false, "web.test A 2001:db8::1\n"},
+		{"override AAAA with IPv4", false, "web.test AAAA 192.0.2.1\n"},
+		{"override unsupported type", false, "web.test MX mail.test\n"},
+		{"override missing address", false, "web.test A\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ld := NewLocalData(300)
+			parse := ld.ParseOverrides
+			if tt.hosts {
+				parse = ld.ParseHosts
+			}
+			if err := parse(strings.NewReader(tt.input)); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestResolve_FromLocalData(t *testing.T) {
+	ld := NewLocalData(300)
+	ld.AddAddress("web.test", net.IPv4(192, 0, 2, 10), 300)
+	ld.AddNXDomain("blocked.test")
+	r := NewResolver(zap.NewNop(), Config{LocalData: ld})
+
+	answers, err := r.Resolve("web.test.", parser.RTA, parser.RCIN)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(answers) != 1 || answers[0].RData.String() != "192.0.2.10" {
+		t.Errorf("expected local address, got %v", answers)
+	}
+
+	_, err = r.Resolve("blocked.test.", parser.RTA, parser.RCIN)
+	var nxErr parser.NXDomainError
+	if !errors.As(err, &nxErr) {
+		t.Errorf("expected NXDOMAIN error, got %v", err)
+	}
+}
@@ -1,157 +1,725 @@
 package resolver
 
 import (
+	"context"
 	"dns/internal/parser"
 	"dns/internal/server"
+	"dns/internal/zone"
 	"errors"
+	"fmt"
 	"math/rand"
 	"net"
+	"slices"
+	"strings"
+	"time"
 
 	"go.uber.org/zap"
 )
 
+const maxCNAMEChainLength = 8
+
+type result struct {
+	answers     []parser.DNSResourceRecord
+	authorities []parser.DNSResourceRecord
+	rcode       parser.RCode
+}
+
 type Resolver struct {
-	cache  *cache
-	logger *zap.Logger
+	cache   *cache
+	flights *flightGroup
+	roots   *rootServers
+	servers *nameserverStats
+	rules   map[string]Rule
+	zones   map[string]*zone.Zone
+	config  Config
+	cancel  context.CancelFunc
+	logger  *zap.Logger
 }
 
-var rootServers = []net.IP{
-	net.IPv4(170, 247, 170, 2),
-	net.IPv4(192, 33, 4, 12),
-	net.IPv4(199, 7, 91, 13),
-	net.IPv4(192, 203, 230, 10),
-	net.IPv4(192, 5, 5, 251),
-	net.IPv4(198, 97, 190, 53),
-	net.IPv4(192, 36, 148, 17),
-	net.IPv4(193, 0, 14, 129),
-	net.IPv4(202, 12, 27, 33),
+// orderAddresses shuffles ips, keeping IPv4 addresses ahead of IPv6 ones so
+// that IPv6 is only relied upon when no IPv4 address is available.
+func orderAddresses(ips []net.IP) []net.IP {
+	v4 := make([]net.IP, 0, len(ips))
+	v6 := make([]net.IP, 0)
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	return append(shuffle(v4), shuffle(v6)...)
 }
 
-func getRootNameserver() net.IP {
-	return rootServers[rand.Intn(len(rootServers))]
+func shuffle(ips []net.IP) []net.IP {
+	res := slices.Clone(ips)
+	rand.Shuffle(len(res), func(i, j int) {
+		res[i], res[j] = res[j], res[i]
+	})
+	return res
 }
 
 func getRecordIP(rr parser.DNSResourceRecord) net.IP {
 	switch rd := rr.RData.(type) {
 	case parser.ARecord:
 		return rd.IP
+	case parser.AAAARecord:
+		return rd.IP
 	}
 	return nil
 }
 
-func getAuthorities(msg parser.DNSMessage) map[string]net.IP {
-	authorities := make(map[string]net.IP)
-	for _, authority := range msg.Authorities {
-		authorities[authority.Name] = nil
-	}
+// getNameservers returns the glue addresses of the nameservers a referral
+// points to, along with the names of those that came without glue.
+func getNameservers(msg parser.DNSMessage) ([]net.IP, []string) {
+	glue := make(map[string][]net.IP)
 	for _, additional := range msg.Additionals {
 		ip := getRecordIP(additional)
 		if ip != nil {
-			authorities[additional.Name] = ip
+			glue[strings.ToLower(additional.Name)] = append(glue[strings.ToLower(additional.Name)], ip)
 		}
 	}
-	return authorities
+	ips := make([]net.IP, 0)
+	names := make([]string, 0)
+	for _, authority := range msg.Authorities {
+		rd, ok := authority.RData.(parser.NSRecord)
+		if !ok {
+			continue
+		}
+		if addrs, ok := glue[strings.ToLower(rd.Name)]; ok {
+			ips = append(ips, addrs...)
+		} else if !slices.Contains(names, rd.Name) {
+			names = append(names, rd.Name)
+		}
+	}
+	rand.Shuffle(len(names), func(i, j int) {
+		names[i], names[j] = names[j], names[i]
+	})
+	return orderAddresses(ips), names
 }
 
-func (r *Resolver) cacheMessage(domain string, msg parser.DNSMessage) {
-	for _, record := range msg.Answers {
-		r.cache.Add(domain, record)
+func (r *Resolver) cacheMessage(msg parser.DNSMessage) {
+	r.cache.Add(msg.Answers)
+	r.cache.Add(msg.Authorities)
+	additionals := make([]parser.DNSResourceRecord, 0, len(msg.Additionals))
+	for _, record := range msg.Additionals {
+		if record.Type != parser.RTOPT {
+			additionals = append(additionals, record)
+		}
 	}
-	for _, record := range msg.Authorities {
-		r.cache.Add(domain, record)
+	r.cache.Add(additionals)
+}
+
+func getParentZone(name string) string {
+	name = canonicalName(name)
+	if name == "." {
+		return ""
 	}
-	for _, record := range msg.Additionals {
-		r.cache.Add(domain, record)
+	_, parent, _ := strings.Cut(name, ".")
+	if parent == "" {
+		return "."
 	}
+	return parent
 }
 
-func (r *Resolver) getAuthority(msg parser.DNSMessage) (net.IP, error) {
-	authorities := getAuthorities(msg)
-	for _, v := range authorities {
-		if v != nil {
-			return v, nil
+// getCachedDelegation finds the closest zone enclosing domain whose NS set
+// and at least one glue address are cached, so iteration can start there
+// instead of at the root.
+func (r *Resolver) getCachedDelegation(domain string, qclass parser.RecordClass) ([]net.IP, []string, string, bool) {
+	for zone := canonicalName(domain); zone != ""; zone = getParentZone(zone) {
+		nsRecords, found := r.cache.Get(cacheKey{zone, parser.RTNS, qclass})
+		if !found {
+			continue
+		}
+		ips := make([]net.IP, 0)
+		names := make([]string, 0)
+		for _, rr := range nsRecords {
+			rd, ok := rr.RData.(parser.NSRecord)
+			if !ok {
+				continue
+			}
+			glue := make([]net.IP, 0)
+			for _, qtype := range []parser.RecordType{parser.RTA, parser.RTAAAA} {
+				addrs, _ := r.cache.Get(cacheKey{rd.Name, qtype, qclass})
+				for _, addr := range addrs {
+					if ip := getRecordIP(addr); ip != nil {
+						glue = append(glue, ip)
+					}
+				}
+			}
+			if len(glue) > 0 {
+				ips = append(ips, glue...)
+			} else {
+				names = append(names, rd.Name)
+			}
 		}
+		if len(ips) > 0 {
+			return orderAddresses(ips), names, zone, true
+		}
+	}
+	return nil, nil, "", false
+}
+
+// maxNameserverDepth bounds how many glueless nameserver lookups may be
+// nested inside one another, so that nameservers named inside the zones
+// they serve cannot make resolution recurse without end.
+const maxNameserverDepth = 6
+
+type nameserverDepthKey struct{}
+
+func getNameserverDepth(ctx context.Context) int {
+	depth, _ := ctx.Value(nameserverDepthKey{}).(int)
+	return depth
+}
+
+func (r *Resolver) resolveNameserver(ctx context.Context, name string) []net.IP {
+	depth := getNameserverDepth(ctx)
+	if depth >= maxNameserverDepth {
+		r.logger.Debug("Nameserver lookups nested too deeply", zap.String("Nameserver", name), zap.Int("Depth", depth))
+		return nil
 	}
-	for k, _ := range authorities {
-		ans, err := r.Resolve(k, parser.RTA, parser.RCIN)
+	ctx = context.WithValue(ctx, nameserverDepthKey{}, depth+1)
+	ips := make([]net.IP, 0)
+	for _, qtype := range []parser.RecordType{parser.RTA, parser.RTAAAA} {
+		ans, err := r.ResolveContext(ctx, name, qtype, parser.RCIN)
 		if err != nil {
+			r.logger.Debug("Could not resolve nameserver", zap.String("Nameserver", name), zap.String("Type", qtype.String()), zap.Error(err))
 			continue
 		}
-		ip := getRecordIP(ans[rand.Intn(len(ans))])
-		if ip != nil {
-			return ip, nil
+		for _, rr := range ans {
+			if ip := getRecordIP(rr); ip != nil && rr.Type == qtype {
+				ips = append(ips, ip)
+			}
+		}
+		if len(ips) > 0 {
+			break
 		}
 	}
-	return nil, errors.New("Could not resolve any authorities")
+	return orderAddresses(ips)
 }
 
-func (r *Resolver) resolveOnce(domain string, qtype parser.RecordType, qclass parser.RecordClass, ns net.IP, protocol server.Protocol) (parser.DNSMessage, error) {
-	q := parser.CreateQuery(domain, qtype, qclass)
-	res, err := server.SendMessage(q, ns, protocol)
+// ErrCanceled is returned when the context passed to a resolution is
+// canceled or its deadline passes before an answer is found.
+var ErrCanceled = errors.New("Resolution canceled")
+
+func canceledError(err error) error {
+	return fmt.Errorf("%w: %w", ErrCanceled, err)
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &ne) && ne.Timeout()
+}
+
+// queryNameservers asks each server in turn until one gives a usable
+// response, retrying servers that time out. Nameserver names without glue
+// are only resolved once every known address has failed. Recursive queries
+// are sent to upstream resolvers when forwarding.
+func (r *Resolver) queryNameservers(ctx context.Context, domain string, qtype parser.RecordType, qclass parser.RecordClass, ips []net.IP, names []string, recursive bool) (parser.DNSMessage, error) {
+	var lastErr error
+	ips = r.servers.Order(ips)
+	for len(ips) > 0 || len(names) > 0 {
+		if len(ips) == 0 {
+			ips = r.servers.Order(r.resolveNameserver(ctx, names[0]))
+			names = names[1:]
+			continue
+		}
+		ns := ips[0]
+		ips = ips[1:]
+		for attempt := 0; attempt <= r.config.Retries; attempt++ {
+			if err := ctx.Err(); err != nil {
+				return parser.DNSMessage{}, canceledError(err)
+			}
+			r.logger.Debug("Resolving", zap.String("Nameserver", ns.String()), zap.Int("Attempt", attempt))
+			start := time.Now()
+			msg, err := r.exchange(ctx, domain, qtype, qclass, ns, recursive)
+			if ctx.Err() != nil {
+				return parser.DNSMessage{}, canceledError(ctx.Err())
+			}
+			if err == nil {
+				err = getRCodeError(msg.GetRCode(), domain, ns)
+			}
+			if err == nil {
+				r.servers.RecordRTT(ns, time.Since(start))
+				return msg, nil
+			}
+			r.servers.RecordFailure(ns, isTimeout(err))
+			r.logger.Debug("Nameserver failed", zap.String("Nameserver", ns.String()), zap.Error(err))
+			lastErr = err
+			if !isTimeout(err) {
+				break
+			}
+		}
+	}
+	if lastErr == nil {
+		return parser.DNSMessage{}, parser.ServFailError{Err: fmt.Errorf("No nameservers available for %s", domain)}
+	}
+	var ce parser.CustomError
+	if errors.As(lastErr, &ce) {
+		return parser.DNSMessage{}, lastErr
+	}
+	return parser.DNSMessage{}, parser.ServFailError{Err: fmt.Errorf("All nameservers failed for %s: %w", domain, lastErr)}
+}
+
+func createQuery(domain string, qtype parser.RecordType, qclass parser.RecordClass, edns bool, recursive bool) []byte {
+	switch {
+	case recursive && edns:
+		return parser.CreateRecursiveQuery(domain, qtype, qclass, parser.EDNSUDPSize)
+	case recursive:
+		return parser.CreateRecursiveQuery(domain, qtype, qclass, 0)
+	case edns:
+		return parser.CreateEDNSQuery(domain, qtype, qclass, parser.EDNSUDPSize)
+	}
+	return parser.CreateQuery(domain, qtype, qclass)
+}
+
+func (r *Resolver) resolveOnce(ctx context.Context, domain string, qtype parser.RecordType, qclass parser.RecordClass, ns net.IP, protocol server.Protocol, edns bool, recursive bool) (parser.DNSMessage, error) {
+	q := createQuery(domain, qtype, qclass, edns, recursive)
+	if r.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.config.Timeout)
+		defer cancel()
+	}
+	var msg parser.DNSMessage
+	_, err := server.SendMessage(ctx, q, ns, protocol, func(res []byte) bool {
+		var err error
+		msg, err = parser.ParseDNSMessage(res, parser.Response)
+		if err == nil {
+			err = validateResponse(q, msg, domain, qtype, qclass)
+		}
+		if err != nil {
+			r.logger.Debug("Dropping invalid response", zap.String("Nameserver", ns.String()), zap.Error(err))
+			return false
+		}
+		return true
+	})
 	if err != nil {
 		return parser.DNSMessage{}, err
 	}
-	msg, err := parser.ParseDNSMessage(res, parser.Response)
+	return msg, nil
+}
+
+// exchange sends a single query to ns, advertising our EDNS buffer size. Servers
+// that reject EDNS are retried with a plain RFC 1035 query, and truncated
+// responses are retried over TCP.
+func (r *Resolver) exchange(ctx context.Context, domain string, qtype parser.RecordType, qclass parser.RecordClass, ns net.IP, recursive bool) (parser.DNSMessage, error) {
+	edns := true
+	msg, err := r.resolveOnce(ctx, domain, qtype, qclass, ns, server.UDP, edns, recursive)
 	if err != nil {
 		return parser.DNSMessage{}, err
 	}
+	r.logger.Debug("Intermediate response", zap.String("Message", msg.String()))
+	if _, ok := msg.GetEDNS(); !ok && (msg.Header.GetRCode() == parser.FormErr || msg.Header.GetRCode() == parser.NotImp) {
+		r.logger.Debug("Server does not support EDNS, Retrying without it")
+		edns = false
+		msg, err = r.resolveOnce(ctx, domain, qtype, qclass, ns, server.UDP, edns, recursive)
+		if err != nil {
+			return parser.DNSMessage{}, err
+		}
+		r.logger.Debug("Intermediate response", zap.String("Message", msg.String()))
+	}
+	if msg.Header.GetTC() {
+		r.logger.Debug("Response was truncated, Retrying with TCP")
+		msg, err = r.resolveOnce(ctx, domain, qtype, qclass, ns, server.TCP, edns, recursive)
+		if err != nil {
+			return parser.DNSMessage{}, err
+		}
+		r.logger.Debug("Intermediate response", zap.String("Message", msg.String()))
+	}
 	return msg, nil
 }
 
-func (r *Resolver) Resolve(domain string, qtype parser.RecordType, qclass parser.RecordClass) ([]parser.DNSResourceRecord, error) {
+func (r *Resolver) getCached(domain string, qtype parser.RecordType, qclass parser.RecordClass) ([]parser.DNSResourceRecord, bool) {
 	ck := cacheKey{domain, qtype, qclass}
 	val, found := r.cache.Get(ck)
 	if found {
 		r.logger.Debug("Cache hit", zap.String("Key", ck.String()))
-		return val, nil
 	}
-	ns := getRootNameserver()
+	if qtype == parser.RTCNAME {
+		return val, found
+	}
+	cnameKey := cacheKey{domain, parser.RTCNAME, qclass}
+	cnames, cnameFound := r.cache.Get(cnameKey)
+	if cnameFound {
+		r.logger.Debug("Cache hit", zap.String("Key", cnameKey.String()))
+	}
+	return append(cnames, val...), found || cnameFound
+}
+
+func getRCodeError(rcode parser.RCode, domain string, ns net.IP) error {
+	switch rcode {
+	case parser.FormErr:
+		return parser.ServFailError{Err: fmt.Errorf("%v rejected query for %s as malformed", ns, domain)}
+	case parser.ServFail:
+		return parser.ServFailError{Err: fmt.Errorf("%v failed to resolve %s", ns, domain)}
+	case parser.NotImp:
+		return parser.NotImpError{Err: fmt.Errorf("%v does not implement query for %s", ns, domain)}
+	case parser.Refused:
+		return parser.RefusedError{Err: fmt.Errorf("%v refused query for %s", ns, domain)}
+	case parser.BadVers:
+		return parser.ServFailError{Err: fmt.Errorf("%v does not support our EDNS version", ns)}
+	}
+	return nil
+}
+
+// withQueryID rewrites err into the error type the client should see,
+// carrying the ID of the client's query. Anything that is not already one
+// of the parser's error types is reported as a server failure.
+func withQueryID(err error, id uint16) parser.CustomError {
+	var ce parser.CustomError
+	if !errors.As(err, &ce) {
+		return parser.ServFailError{Err: err, ID: id}
+	}
+	switch e := ce.(type) {
+	case parser.ServFailError:
+		e.ID = id
+		return e
+	case parser.NXDomainError:
+		e.ID = id
+		return e
+	case parser.NotImpError:
+		e.ID = id
+		return e
+	case parser.RefusedError:
+		e.ID = id
+		return e
+	}
+	return parser.ServFailError{Err: err, ID: id}
+}
+
+func getSOA(records []parser.DNSResourceRecord) (parser.DNSResourceRecord, bool) {
+	for _, rr := range records {
+		if rr.Type == parser.RTSOA {
+			return rr, true
+		}
+	}
+	return parser.DNSResourceRecord{}, false
+}
+
+func isReferral(msg parser.DNSMessage) bool {
+	for _, rr := range msg.Authorities {
+		if rr.Type == parser.RTNS {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Resolver) cacheNegative(domain string, qtype parser.RecordType, qclass parser.RecordClass, rcode parser.RCode, msg parser.DNSMessage) result {
+	soa, ok := getSOA(msg.Authorities)
+	if !ok {
+		return result{rcode: rcode}
+	}
+	r.cache.AddNegative(cacheKey{domain, qtype, qclass}, rcode, soa)
+	return result{rcode: rcode, authorities: []parser.DNSResourceRecord{getNegativeSOA(soa)}}
+}
+
+func (r *Resolver) resolveName(ctx context.Context, domain string, qtype parser.RecordType, qclass parser.RecordClass) (result, error) {
+	if res, ok := r.config.LocalData.lookup(domain, qtype, qclass); ok {
+		r.logger.Debug("Answering from local data", zap.String("Domain", domain))
+		return res, nil
+	}
+	if z, ok := r.getZone(domain, qclass); ok {
+		if a := z.Lookup(domain, qtype); a.Authoritative {
+			r.logger.Debug("Answering from zone", zap.String("Zone", z.Origin), zap.String("Domain", domain))
+			return result{answers: a.Answers, authorities: a.Authorities, rcode: a.RCode}, nil
+		}
+	}
+	val, found := r.getCached(domain, qtype, qclass)
+	if found {
+		r.cache.RecordLookup(true)
+		r.prefetch(domain, qtype, qclass)
+		return result{answers: val}, nil
+	}
+	ck := cacheKey{domain, qtype, qclass}
+	if entry, found := r.cache.GetNegative(ck); found {
+		r.logger.Debug("Negative cache hit", zap.String("Key", ck.String()))
+		r.cache.RecordLookup(true)
+		return result{rcode: entry.rcode, authorities: []parser.DNSResourceRecord{entry.soa}}, nil
+	}
+	r.cache.RecordLookup(false)
+	res, err := r.flights.Do(ctx, ck.canonical(), func(ctx context.Context) (result, error) {
+		return r.iterate(ctx, domain, qtype, qclass)
+	})
+	if err != nil && ctx.Err() == nil {
+		if val, found := r.getStale(domain, qtype, qclass); found {
+			r.logger.Warn("Serving stale data", zap.String("Key", ck.String()), zap.Error(err))
+			return result{answers: val}, nil
+		}
+	}
+	return res, err
+}
+
+func (r *Resolver) getStale(domain string, qtype parser.RecordType, qclass parser.RecordClass) ([]parser.DNSResourceRecord, bool) {
+	val, found := r.cache.GetStale(cacheKey{domain, qtype, qclass})
+	if found || qtype == parser.RTCNAME {
+		return val, found
+	}
+	return r.cache.GetStale(cacheKey{domain, parser.RTCNAME, qclass})
+}
+
+// prefetch refreshes a popular cached RRset in the background so that it is
+// replaced before it expires.
+func (r *Resolver) prefetch(domain string, qtype parser.RecordType, qclass parser.RecordClass) {
+	for _, t := range []parser.RecordType{qtype, parser.RTCNAME} {
+		ck := cacheKey{domain, t, qclass}
+		if !r.cache.ShouldPrefetch(ck) {
+			continue
+		}
+		r.logger.Debug("Prefetching", zap.String("Key", ck.String()))
+		go func() {
+			_, err := r.flights.Do(context.Background(), ck.canonical(), func(ctx context.Context) (result, error) {
+				return r.iterate(ctx, domain, t, qclass)
+			})
+			if err != nil {
+				r.logger.Debug("Prefetch failed", zap.String("Key", ck.String()), zap.Error(err))
+			}
+		}()
+	}
+}
+
+// iterate resolves domain by walking down from the closest cached delegation,
+// or the root, without consulting the cache for the name itself.
+func (r *Resolver) iterate(ctx context.Context, domain string, qtype parser.RecordType, qclass parser.RecordClass) (result, error) {
+	ips, names, zone, found := r.getCachedDelegation(domain, qclass)
+	// Names delegated away from a zone we serve start at its zone cut, and
+	// those in a stub zone at its servers, unless a delegation below them
+	// has been cached.
+	if cutIPs, cutNames, cut, ok := r.getZoneDelegation(domain, qclass); ok {
+		if !found || zone == cut || !isSubdomain(zone, cut) {
+			r.logger.Debug("Starting from zone cut", zap.String("Zone", cut))
+			ips, names, zone = cutIPs, cutNames, cut
+		}
+		return r.iterateFrom(ctx, domain, qtype, qclass, ips, names, zone)
+	}
+	rule, hasRule := r.getRule(domain)
+	if hasRule && rule.Type == ForwardRule {
+		return r.forward(ctx, domain, qtype, qclass, rule.Servers)
+	}
+	if hasRule && (!found || zone == rule.Zone || !isSubdomain(zone, rule.Zone)) {
+		r.logger.Debug("Starting from stub zone", zap.String("Zone", rule.Zone))
+		ips, names, zone = orderAddresses(rule.Servers), []string{}, rule.Zone
+	} else if found {
+		r.logger.Debug("Starting from cached delegation", zap.String("Zone", zone))
+	} else {
+		ips, names, zone = r.getRootNameservers(), []string{}, "."
+	}
+	return r.iterateFrom(ctx, domain, qtype, qclass, ips, names, zone)
+}
+
+// iterateFrom follows referrals for domain starting at the servers of zone.
+func (r *Resolver) iterateFrom(ctx context.Context, domain string, qtype parser.RecordType, qclass parser.RecordClass, ips []net.IP, names []string, zone string) (result, error) {
 	for {
-		r.logger.Debug("Resolving", zap.String("Nameserver", ns.String()))
-		msg, err := r.resolveOnce(domain, qtype, qclass, ns, server.UDP)
+		msg, err := r.queryNameservers(ctx, domain, qtype, qclass, ips, names, false)
 		if err != nil {
-			return nil, err
+			return result{}, err
 		}
-		r.logger.Debug("Intermediate response", zap.String("Message", msg.String()))
-		if msg.Header.GetTC() {
-			r.logger.Debug("Response was truncated, Retrying with TCP")
-			msg, err = r.resolveOnce(domain, qtype, qclass, ns, server.TCP)
-			r.logger.Debug("Intermediate response", zap.String("Message", msg.String()))
-			if err != nil {
-				return nil, err
+		msg, dropped, err := sanitizeResponse(msg, zone, domain)
+		if err != nil {
+			return result{}, parser.ServFailError{Err: err}
+		}
+		if dropped > 0 {
+			r.logger.Debug("Dropped out-of-bailiwick records", zap.String("Zone", zone), zap.String("Domain", domain), zap.Int("Count", dropped))
+		}
+		if res, ok := r.getResult(domain, qtype, qclass, msg); ok {
+			return res, nil
+		}
+		r.cacheMessage(msg)
+		ips, names = getNameservers(msg)
+		zone = getReferralZone(msg)
+		r.logger.Debug("Following referral", zap.String("Zone", zone))
+	}
+}
+
+// getResult caches and returns the outcome of msg if it answers the query,
+// or reports that msg is a referral that has to be followed.
+func (r *Resolver) getResult(domain string, qtype parser.RecordType, qclass parser.RecordClass, msg parser.DNSMessage) (result, bool) {
+	if msg.Header.ANCount > 0 {
+		r.logger.Debug("Answer recieved")
+		r.cacheMessage(msg)
+		res := result{answers: msg.Answers, rcode: msg.Header.GetRCode()}
+		if soa, ok := getSOA(msg.Authorities); ok && res.rcode == parser.NXDomain {
+			res.authorities = []parser.DNSResourceRecord{soa}
+		}
+		return res, true
+	}
+	if msg.Header.GetRCode() == parser.NXDomain {
+		r.logger.Debug("Name does not exist")
+		return r.cacheNegative(domain, qtype, qclass, parser.NXDomain, msg), true
+	}
+	if !isReferral(msg) {
+		r.logger.Debug("No data for name")
+		return r.cacheNegative(domain, qtype, qclass, parser.NoError, msg), true
+	}
+	return result{}, false
+}
+
+// forward resolves domain by sending a recursive query to upstream resolvers,
+// whose response is taken as the final answer.
+func (r *Resolver) forward(ctx context.Context, domain string, qtype parser.RecordType, qclass parser.RecordClass, upstreams []net.IP) (result, error) {
+	r.logger.Debug("Forwarding query", zap.String("Domain", domain))
+	msg, err := r.queryNameservers(ctx, domain, qtype, qclass, upstreams, nil, true)
+	if err != nil {
+		return result{}, err
+	}
+	msg, _, err = sanitizeResponse(msg, ".", domain)
+	if err != nil {
+		return result{}, parser.ServFailError{Err: err}
+	}
+	if res, ok := r.getResult(domain, qtype, qclass, msg); ok {
+		return res, nil
+	}
+	return result{}, parser.ServFailError{Err: fmt.Errorf("Upstream returned a referral for %s instead of recursing", domain)}
+}
+
+// followCNAMEs walks the alias chain starting at domain through records. It
+// returns the records answering the query along with the name the chain
+// still has to be resolved for, which is empty once the chain is complete.
+func followCNAMEs(domain string, qtype parser.RecordType, records []parser.DNSResourceRecord, seen map[string]bool) ([]parser.DNSResourceRecord, string, error) {
+	chain := make([]parser.DNSResourceRecord, 0, len(records))
+	name := domain
+	for {
+		answered := false
+		var target string
+		for _, rr := range records {
+			if !strings.EqualFold(rr.Name, name) {
+				continue
+			}
+			if rr.Type == qtype || qtype == parser.RTSTAR {
+				chain = append(chain, rr)
+				answered = true
+			} else if cname, ok := rr.RData.(parser.CNameRecord); ok && target == "" {
+				chain = append(chain, rr)
+				target = cname.Name
 			}
 		}
-		if msg.Header.ANCount > 0 {
-			r.logger.Debug("Answer recieved")
-			r.cacheMessage(domain, msg)
-			return msg.Answers, nil
+		if answered || target == "" {
+			return chain, "", nil
+		}
+		if seen[strings.ToLower(target)] {
+			return nil, "", fmt.Errorf("CNAME loop detected at %s", target)
 		}
-		ns, err = r.getAuthority(msg)
+		if len(seen) > maxCNAMEChainLength {
+			return nil, "", errors.New("CNAME chain too long")
+		}
+		seen[strings.ToLower(target)] = true
+		name = target
+		if !slices.ContainsFunc(records, func(rr parser.DNSResourceRecord) bool {
+			return strings.EqualFold(rr.Name, name)
+		}) {
+			return chain, name, nil
+		}
+	}
+}
+
+func (r *Resolver) resolve(ctx context.Context, domain string, qtype parser.RecordType, qclass parser.RecordClass) (result, error) {
+	answers := make([]parser.DNSResourceRecord, 0)
+	seen := map[string]bool{strings.ToLower(domain): true}
+	name := domain
+	for {
+		if err := ctx.Err(); err != nil {
+			return result{}, canceledError(err)
+		}
+		res, err := r.resolveName(ctx, name, qtype, qclass)
 		if err != nil {
-			return nil, err
+			return result{}, err
+		}
+		chain, next, err := followCNAMEs(name, qtype, res.answers, seen)
+		if err != nil {
+			return result{}, err
+		}
+		answers = append(answers, chain...)
+		if next == "" || res.rcode != parser.NoError {
+			return result{answers: answers, authorities: res.authorities, rcode: res.rcode}, nil
 		}
+		r.logger.Debug("Following CNAME", zap.String("Target", next))
+		name = next
 	}
 }
 
+func (r *Resolver) Resolve(domain string, qtype parser.RecordType, qclass parser.RecordClass) ([]parser.DNSResourceRecord, error) {
+	return r.ResolveContext(context.Background(), domain, qtype, qclass)
+}
+
+func (r *Resolver) ResolveContext(ctx context.Context, domain string, qtype parser.RecordType, qclass parser.RecordClass) ([]parser.DNSResourceRecord, error) {
+	res, err := r.resolve(ctx, domain, qtype, qclass)
+	if err != nil {
+		return nil, err
+	}
+	if res.rcode == parser.NXDomain {
+		return nil, parser.NXDomainError{Err: fmt.Errorf("%s does not exist", domain)}
+	}
+	return res.answers, nil
+}
+
 func (r *Resolver) ResolveQuery(q parser.DNSMessage) (parser.DNSMessage, error) {
+	return r.ResolveQueryContext(context.Background(), q)
+}
+
+func (r *Resolver) ResolveQueryContext(ctx context.Context, q parser.DNSMessage) (parser.DNSMessage, error) {
+	if len(q.Questions) == 1 {
+		question := q.Questions[0]
+		_, pinned := r.config.LocalData.lookup(question.QName, question.QType, question.QClass)
+		if z, ok := r.getZone(question.QName, question.QClass); ok && !pinned {
+			r.logger.Debug("Answering from zone", zap.String("Zone", z.Origin))
+			a := z.Lookup(question.QName, question.QType)
+			return parser.CreateAuthoritativeResponseMessage(q, a.RCode, a.Authoritative, a.Answers, a.Authorities, a.Additionals), nil
+		}
+	}
 	answers := make([]parser.DNSResourceRecord, 0)
+	authorities := make([]parser.DNSResourceRecord, 0)
+	rcode := parser.NoError
 	for _, question := range q.Questions {
 		domain := question.QName
 		qtype := question.QType
 		qclass := question.QClass
 
-		ans, err := r.Resolve(domain, qtype, qclass)
+		res, err := r.resolve(ctx, domain, qtype, qclass)
 		if err != nil {
-			return parser.DNSMessage{}, err
+			return parser.DNSMessage{}, withQueryID(err, q.Header.ID)
+		}
+		answers = append(answers, res.answers...)
+		authorities = append(authorities, res.authorities...)
+		if res.rcode != parser.NoError {
+			rcode = res.rcode
 		}
-		answers = append(answers, ans...)
 	}
-	return parser.CreateAnswerMessage(q, answers), nil
+	return parser.CreateResponseMessage(q, rcode, answers, authorities), nil
 }
 
-func NewResolver(logger *zap.Logger) Resolver {
-	return Resolver{
-		cache:  NewCache(logger),
-		logger: logger,
+func (r *Resolver) CacheStats() CacheStats {
+	return r.cache.Stats()
+}
+
+func (r *Resolver) Close() {
+	r.cancel()
+	r.cache.Close()
+}
+
+func NewResolver(logger *zap.Logger, config Config) Resolver {
+	hints := builtinRootHints
+	if config.RootHints != "" {
+		ips, err := loadRootHints(config.RootHints)
+		if err != nil {
+			logger.Error("Could not load root hints, using built-in hints", zap.String("File", config.RootHints), zap.Error(err))
+		} else {
+			hints = ips
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := Resolver{
+		cache:   NewCache(logger, config.Cache),
+		flights: newFlightGroup(),
+		roots:   &rootServers{ips: hints},
+		servers: newNameserverStats(),
+		rules:   getRules(config),
+		zones:   getZones(config),
+		config:  config,
+		cancel:  cancel,
+		logger:  logger,
+	}
+	if _, ok := r.rules["."]; config.PrimeInterval > 0 && !ok {
+		go r.primePeriodically(ctx, config.PrimeInterval)
 	}
+	return r
 }
@@ -0,0 +1,575 @@
+package resolver
+
+import (
+	"context"
+	"dns/internal/parser"
+	"dns/internal/server"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// testConfig returns the default configuration without background priming
+// of the root servers.
+func testConfig() Config {
+	cfg := DefaultConfig()
+	cfg.PrimeInterval = 0
+	return cfg
+}
+
+func makeCNameRecord(name string, target string) parser.DNSResourceRecord {
+	return parser.DNSResourceRecord{
+		Name:  name,
+		Type:  parser.RTCNAME,
+		Class: parser.RCIN,
+		TTL:   60,
+		RData: parser.CNameRecord{Name: target},
+	}
+}
+
+func TestFollowCNAMEs(t *testing.T) {
+	tests := []struct {
+		name        string
+		qtype       parser.RecordType
+		records     []parser.DNSResourceRecord
+		expectError bool
+		expectChain int
+		expectNext  string
+	}{
+		{
+			name:        "direct answer",
+			qtype:       parser.RTA,
+			records:     []parser.DNSResourceRecord{makeARecord("www.example.com.", 60)},
+			expectChain: 1,
+		},
+		{
+			name:  "complete chain in one response",
+			qtype: parser.RTA,
+			records: []parser.DNSResourceRecord{
+				makeCNameRecord("www.example.com.", "a.example.net."),
+				makeCNameRecord("a.example.net.", "b.example.org."),
+				makeARecord("b.example.org.", 60),
+			},
+			expectChain: 3,
+		},
+		{
+			name:  "chain leaves the response",
+			qtype: parser.RTA,
+			records: []parser.DNSResourceRecord{
+				makeCNameRecord("www.example.com.", "a.example.net."),
+			},
+			expectChain: 1,
+			expectNext:  "a.example.net.",
+		},
+		{
+			name:  "CNAME query returns alias only",
+			qtype: parser.RTCNAME,
+			records: []parser.DNSResourceRecord{
+				makeCNameRecord("www.example.com.", "a.example.net."),
+			},
+			expectChain: 1,
+		},
+		{
+			name:  "alias loop",
+			qtype: parser.RTA,
+			records: []parser.DNSResourceRecord{
+				makeCNameRecord("www.example.com.", "a.example.net."),
+				makeCNameRecord("a.example.net.", "www.example.com."),
+			},
+			expectError: true,
+		},
+		{
+			name:        "no matching records",
+			qtype:       parser.RTA,
+			records:     []parser.DNSResourceRecord{makeARecord("other.example.com.", 60)},
+			expectChain: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen := map[string]bool{"www.example.com.": true}
+			chain, next, err := followCNAMEs("www.example.com.", tt.qtype, tt.records, seen)
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(chain) != tt.expectChain {
+				t.Errorf("expected %d records in chain, got %d", tt.expectChain, len(chain))
+			}
+			if next != tt.expectNext {
+				t.Errorf("expected next name %q, got %q", tt.expectNext, next)
+			}
+		})
+	}
+}
+
+func TestFollowCNAMEs_ChainTooLong(t *testing.T) {
+	records := make([]parser.DNSResourceRecord, 0)
+	for i := 0; i < maxCNAMEChainLength+2; i++ {
+		records = append(records, makeCNameRecord(fmt.Sprintf("%d.example.com.", i), fmt.Sprintf("%d.example.com.", i+1)))
+	}
+	seen := map[string]bool{"0.example.com.": true}
+	_, _, err := followCNAMEs("0.example.com.", parser.RTA, records, seen)
+	if err == nil {
+		t.Error("expected error for overlong chain, got none")
+	}
+}
+
+func TestGetRCodeError(t *testing.T) {
+	ns := net.IPv4(192, 0, 2, 1)
+	tests := []struct {
+		rcode       parser.RCode
+		expectRCode parser.RCode
+		expectNil   bool
+	}{
+		{rcode: parser.NoError, expectNil: true},
+		{rcode: parser.NXDomain, expectNil: true},
+		{rcode: parser.FormErr, expectRCode: parser.ServFail},
+		{rcode: parser.ServFail, expectRCode: parser.ServFail},
+		{rcode: parser.NotImp, expectRCode: parser.NotImp},
+		{rcode: parser.Refused, expectRCode: parser.Refused},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.rcode.String(), func(t *testing.T) {
+			err := getRCodeError(tt.rcode, "example.com.", ns)
+			if tt.expectNil {
+				if err != nil {
+					t.Errorf("expected no error, got %v", err)
+				}
+				return
+			}
+			msg := parser.CreateErrorResponseMessage(withQueryID(err, 0x1234), nil)
+			if msg.Header.GetRCode() != tt.expectRCode {
+				t.Errorf("expected RCODE %v, got %v", tt.expectRCode, msg.Header.GetRCode())
+			}
+		})
+	}
+}
+
+func TestWithQueryID(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         error
+		expectRCode parser.RCode
+	}{
+		{"plain error", errors.New("network unreachable"), parser.ServFail},
+		{"wrapped refusal", fmt.Errorf("resolving: %w", parser.RefusedError{Err: errors.New("no"), ID: 7}), parser.Refused},
+		{"upstream parse failure", parser.ServFailError{Err: parser.NotImpError{Err: errors.New("type 46")}}, parser.ServFail},
+		{"form error", parser.FormError{Err: errors.New("bad")}, parser.ServFail},
+		{"nxdomain", parser.NXDomainError{Err: errors.New("missing")}, parser.NXDomain},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ce := withQueryID(tt.err, 0xbeef)
+			if ce.GetID() != 0xbeef {
+				t.Errorf("expected ID 0xbeef, got %#x", ce.GetID())
+			}
+			msg := parser.CreateErrorResponseMessage(ce, nil)
+			if msg.Header.GetRCode() != tt.expectRCode {
+				t.Errorf("expected RCODE %v, got %v", tt.expectRCode, msg.Header.GetRCode())
+			}
+		})
+	}
+}
+
+func TestCacheNegative_AuthoritySOA(t *testing.T) {
+	r := NewResolver(zap.NewNop(), testConfig())
+	defer r.Close()
+
+	tests := []struct {
+		name      string
+		ttl       uint32
+		minimum   uint32
+		expectTTL uint32
+	}{
+		{"minimum below TTL", 3600, 300, 300},
+		{"zero minimum", 3600, 0, 0},
+		{"zero TTL", 0, 300, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			soa := makeSOARecord("example.com.", tt.ttl, tt.minimum)
+			msg := parser.DNSMessage{Authorities: []parser.DNSResourceRecord{soa}}
+			res := r.cacheNegative("missing.example.com.", parser.RTA, parser.RCIN, parser.NXDomain, msg)
+			if len(res.authorities) != 1 {
+				t.Fatalf("expected the SOA in the authority section, got %v", res.authorities)
+			}
+			got := res.authorities[0]
+			if got.Type != parser.RTSOA || got.Name != soa.Name || got.TTL != tt.expectTTL {
+				t.Errorf("expected %s SOA with TTL %d, got %v", soa.Name, tt.expectTTL, got)
+			}
+		})
+	}
+}
+
+func makeNSRecord(zone string, ns string) parser.DNSResourceRecord {
+	return parser.DNSResourceRecord{
+		Name:  zone,
+		Type:  parser.RTNS,
+		Class: parser.RCIN,
+		TTL:   172800,
+		RData: parser.NSRecord{Name: ns},
+	}
+}
+
+func TestGetNameservers(t *testing.T) {
+	glue := makeARecord("a.gtld-servers.net.", 172800)
+	msg := parser.DNSMessage{
+		Authorities: []parser.DNSResourceRecord{
+			makeNSRecord("com.", "a.gtld-servers.net."),
+			makeNSRecord("com.", "b.gtld-servers.net."),
+			makeNSRecord("com.", "b.gtld-servers.net."),
+		},
+		Additionals: []parser.DNSResourceRecord{
+			glue,
+			makeARecord("unrelated.example.", 60),
+			parser.CreateOPTRecord(parser.EDNS{UDPSize: 1232}),
+		},
+	}
+
+	ips, names := getNameservers(msg)
+	if len(ips) != 1 || !ips[0].Equal(glue.RData.(parser.ARecord).IP) {
+		t.Errorf("expected glue address only, got %v", ips)
+	}
+	if len(names) != 1 || names[0] != "b.gtld-servers.net." {
+		t.Errorf("expected b.gtld-servers.net. without glue, got %v", names)
+	}
+}
+
+func TestResolveContext_Canceled(t *testing.T) {
+	r := NewResolver(zap.NewNop(), testConfig())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := r.ResolveContext(ctx, "example.com.", parser.RTA, parser.RCIN)
+	if !errors.Is(err, ErrCanceled) {
+		t.Errorf("expected ErrCanceled, got %v", err)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestResolveNameserver_DepthLimit(t *testing.T) {
+	r := NewResolver(zap.NewNop(), testConfig())
+	defer r.Close()
+	r.cache.Add([]parser.DNSResourceRecord{makeARecord("ns1.example.com.", 300)})
+
+	tests := []struct {
+		name      string
+		depth     int
+		expectIPs int
+	}{
+		{"top level", 0, 1},
+		{"below limit", maxNameserverDepth - 1, 1},
+		{"at limit", maxNameserverDepth, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.WithValue(context.Background(), nameserverDepthKey{}, tt.depth)
+			if ips := r.resolveNameserver(ctx, "ns1.example.com."); len(ips) != tt.expectIPs {
+				t.Errorf("expected %d addresses, got %v", tt.expectIPs, ips)
+			}
+		})
+	}
+}
+
+func makeAAAARecord(name string, ip string) parser.DNSResourceRecord {
+	return parser.DNSResourceRecord{
+		Name:  name,
+		Type:  parser.RTAAAA,
+		Class: parser.RCIN,
+		TTL:   172800,
+		RData: parser.AAAARecord{IP: net.ParseIP(ip)},
+	}
+}
+
+func TestGetNameservers_IPv6Glue(t *testing.T) {
+	msg := parser.DNSMessage{
+		Authorities: []parser.DNSResourceRecord{
+			makeNSRecord("example.", "ns1.example."),
+			makeNSRecord("example.", "ns2.example."),
+		},
+		Additionals: []parser.DNSResourceRecord{
+			makeAAAARecord("ns1.example.", "2001:db8::53"),
+			makeAAAARecord("ns2.example.", "2001:db8::54"),
+			makeARecord("ns2.example.", 172800),
+		},
+	}
+
+	ips, names := getNameservers(msg)
+	if len(names) != 0 {
+		t.Errorf("expected all nameservers to have glue, got %v", names)
+	}
+	if len(ips) != 3 {
+		t.Fatalf("expected 3 addresses, got %v", ips)
+	}
+	if ips[0].To4() == nil {
+		t.Errorf("expected IPv4 address first, got %v", ips[0])
+	}
+	for _, ip := range ips[1:] {
+		if ip.To4() != nil {
+			t.Errorf("expected IPv6 addresses after IPv4, got %v", ips)
+		}
+	}
+}
+
+func TestGetParentZone(t *testing.T) {
+	tests := map[string]string{
+		"www.example.com.": "example.com.",
+		"example.com.":     "com.",
+		"com.":             ".",
+		".":                "",
+	}
+	for name, expect := range tests {
+		if got := getParentZone(name); got != expect {
+			t.Errorf("expected parent of %q to be %q, got %q", name, expect, got)
+		}
+	}
+}
+
+func TestGetCachedDelegation(t *testing.T) {
+	r := NewResolver(zap.NewNop(), testConfig())
+	r.cacheMessage(parser.DNSMessage{
+		Authorities: []parser.DNSResourceRecord{
+			makeNSRecord("com.", "a.gtld-servers.net."),
+			makeNSRecord("example.com.", "ns1.example.com."),
+			makeNSRecord("example.com.", "ns2.example.net."),
+			makeNSRecord("noglue.com.", "ns.noglue.com."),
+		},
+		Additionals: []parser.DNSResourceRecord{
+			makeGlue("a.gtld-servers.net.", net.IPv4(192, 5, 6, 30)),
+			makeGlue("ns1.example.com.", net.IPv4(192, 0, 2, 53)),
+		},
+	})
+
+	tests := []struct {
+		domain      string
+		expectFound bool
+		expectZone  string
+		expectIPs   int
+		expectNames int
+	}{
+		{domain: "www.example.com.", expectFound: true, expectZone: "example.com.", expectIPs: 1, expectNames: 1},
+		{domain: "example.com.", expectFound: true, expectZone: "example.com.", expectIPs: 1, expectNames: 1},
+		{domain: "www.noglue.com.", expectFound: true, expectZone: "com.", expectIPs: 1},
+		{domain: "www.example.org.", expectFound: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			ips, names, zone, found := r.getCachedDelegation(tt.domain, parser.RCIN)
+			if found != tt.expectFound {
+				t.Fatalf("expected found %v, got %v", tt.expectFound, found)
+			}
+			if zone != tt.expectZone {
+				t.Errorf("expected zone %q, got %q", tt.expectZone, zone)
+			}
+			if len(ips) != tt.expectIPs {
+				t.Errorf("expected %d addresses, got %v", tt.expectIPs, ips)
+			}
+			if len(names) != tt.expectNames {
+				t.Errorf("expected %d names without glue, got %v", tt.expectNames, names)
+			}
+		})
+	}
+}
+
+// setTestPort points nameserver queries at a free local port for the rest
+// of the test.
+func setTestPort(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	conn.Close()
+	old := server.Port
+	server.Port = port
+	t.Cleanup(func() { server.Port = old })
+}
+
+// startTestNameserver answers UDP queries sent to ip on server.Port with the
+// response built by handle.
+func startTestNameserver(t *testing.T, ip net.IP, handle func(q parser.DNSMessage) parser.DNSMessage) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: server.Port})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, parser.EDNSUDPSize)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			q, err := parser.ParseDNSMessage(buf[:n], parser.Query)
+			if err != nil {
+				continue
+			}
+			conn.WriteToUDP(parser.SerializeDNSMessage(handle(q)), addr)
+		}
+	}()
+}
+
+func answerA(ip string) func(q parser.DNSMessage) parser.DNSMessage {
+	return func(q parser.DNSMessage) parser.DNSMessage {
+		rr := makeARecord(q.Questions[0].QName, 300)
+		rr.RData = parser.ARecord{IP: net.ParseIP(ip).To4()}
+		return parser.CreateResponseMessage(q, parser.NoError, []parser.DNSResourceRecord{rr}, nil)
+	}
+}
+
+func TestResolveOnce_NoTimeout(t *testing.T) {
+	setTestPort(t)
+	ns := net.IPv4(127, 0, 0, 1)
+	startTestNameserver(t, ns, answerA("192.0.2.1"))
+	cfg := testConfig()
+	cfg.Timeout = 0
+	r := NewResolver(zap.NewNop(), cfg)
+	defer r.Close()
+
+	msg, err := r.resolveOnce(context.Background(), "example.com.", parser.RTA, parser.RCIN, ns, server.UDP, true, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(msg.Answers) != 1 || msg.Answers[0].RData.String() != "192.0.2.1" {
+		t.Errorf("expected answer from the nameserver, got %v", msg.Answers)
+	}
+}
+
+func answerServFail(q parser.DNSMessage) parser.DNSMessage {
+	return parser.CreateResponseMessage(q, parser.ServFail, nil, nil)
+}
+
+func TestForward(t *testing.T) {
+	setTestPort(t)
+	failing := net.IPv4(127, 0, 0, 2)
+	upstream := net.IPv4(127, 0, 0, 3)
+	referring := net.IPv4(127, 0, 0, 4)
+	var queries atomic.Int32
+	var recursive atomic.Bool
+	startTestNameserver(t, failing, answerServFail)
+	startTestNameserver(t, upstream, func(q parser.DNSMessage) parser.DNSMessage {
+		queries.Add(1)
+		recursive.Store(q.Header.GetRD())
+		return answerA("192.0.2.1")(q)
+	})
+	startTestNameserver(t, referring, func(q parser.DNSMessage) parser.DNSMessage {
+		return parser.CreateResponseMessage(q, parser.NoError, nil, []parser.DNSResourceRecord{makeNSRecord("com.", "a.gtld-servers.net.")})
+	})
+
+	tests := []struct {
+		name         string
+		forwarders   []net.IP
+		expectAnswer bool
+	}{
+		{"upstream answers", []net.IP{upstream}, true},
+		{"falls back past failing upstream", []net.IP{failing, upstream}, true},
+		{"every upstream fails", []net.IP{failing}, false},
+		{"upstream refers instead of recursing", []net.IP{referring}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queries.Store(0)
+			recursive.Store(false)
+			cfg := testConfig()
+			cfg.Forwarders = tt.forwarders
+			r := NewResolver(zap.NewNop(), cfg)
+			defer r.Close()
+
+			answers, err := r.Resolve("www.example.com.", parser.RTA, parser.RCIN)
+			if !tt.expectAnswer {
+				var sf parser.ServFailError
+				if !errors.As(err, &sf) {
+					t.Errorf("expected SERVFAIL, got %v, %v", answers, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(answers) != 1 || answers[0].RData.String() != "192.0.2.1" {
+				t.Errorf("expected forwarded answer, got %v", answers)
+			}
+			if !recursive.Load() {
+				t.Error("expected forwarded query to have RD set")
+			}
+			if _, err := r.Resolve("www.example.com.", parser.RTA, parser.RCIN); err != nil || queries.Load() != 1 {
+				t.Errorf("expected repeat query to be answered from the cache, %d queries sent, error %v", queries.Load(), err)
+			}
+		})
+	}
+}
+
+func TestResolveOnce_IgnoresSpoofedResponses(t *testing.T) {
+	setTestPort(t)
+	ns := net.IPv4(127, 0, 0, 1)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ns, Port: server.Port})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, parser.EDNSUDPSize)
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		q, err := parser.ParseDNSMessage(buf[:n], parser.Query)
+		if err != nil {
+			return
+		}
+		wrongID := answerA("192.0.2.66")(q)
+		wrongID.Header.ID++
+		wrongQuestion := q
+		wrongQuestion.Questions = []parser.DNSQuestion{{QName: "evil.example.", QType: parser.RTA, QClass: parser.RCIN}}
+		conn.WriteToUDP(parser.SerializeDNSMessage(wrongID), addr)
+		conn.WriteToUDP(parser.SerializeDNSMessage(answerA("192.0.2.66")(wrongQuestion)), addr)
+		conn.WriteToUDP([]byte{0x00}, addr)
+		conn.WriteToUDP(parser.SerializeDNSMessage(answerA("192.0.2.1")(q)), addr)
+	}()
+	r := NewResolver(zap.NewNop(), testConfig())
+	defer r.Close()
+
+	msg, err := r.resolveOnce(context.Background(), "example.com.", parser.RTA, parser.RCIN, ns, server.UDP, true, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(msg.Answers) != 1 || msg.Answers[0].RData.String() != "192.0.2.1" {
+		t.Errorf("expected the genuine answer, got %v", msg.Answers)
+	}
+}
+
+func TestResolveName_CacheStats(t *testing.T) {
+	r := NewResolver(zap.NewNop(), testConfig())
+	defer r.Close()
+	r.cache.Add([]parser.DNSResourceRecord{makeARecord("cached.example.com.", 300)})
+	r.cache.AddNegative(cacheKey{"missing.example.com.", parser.RTA, parser.RCIN}, parser.NXDomain, makeSOARecord("example.com.", 3600, 300))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	r.resolveName(ctx, "cached.example.com.", parser.RTA, parser.RCIN)
+	r.resolveName(ctx, "missing.example.com.", parser.RTA, parser.RCIN)
+	r.resolveName(ctx, "www.example.com.", parser.RTA, parser.RCIN)
+
+	if stats := r.CacheStats(); stats.Hits != 2 || stats.Misses != 1 {
+		t.Errorf("expected 2 hits and 1 miss, got %+v", stats)
+	}
+}
@@ -0,0 +1,172 @@
+package resolver
+
+import (
+	"bufio"
+	"context"
+	"dns/internal/parser"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// builtinRootHints holds the addresses of the 13 root servers, used when no
+// hints file is given or it cannot be read.
+var builtinRootHints = []net.IP{
+	net.ParseIP("198.41.0.4"),
+	net.ParseIP("2001:503:ba3e::2:30"),
+	net.ParseIP("170.247.170.2"),
+	net.ParseIP("2801:1b8:10::b"),
+	net.ParseIP("192.33.4.12"),
+	net.ParseIP("2001:500:2::c"),
+	net.ParseIP("199.7.91.13"),
+	net.ParseIP("2001:500:2d::d"),
+	net.ParseIP("192.203.230.10"),
+	net.ParseIP("2001:500:a8::e"),
+	net.ParseIP("192.5.5.241"),
+	net.ParseIP("2001:500:2f::f"),
+	net.ParseIP("192.112.36.4"),
+	net.ParseIP("2001:500:12::d0d"),
+	net.ParseIP("198.97.190.53"),
+	net.ParseIP("2001:500:1::53"),
+	net.ParseIP("192.36.148.17"),
+	net.ParseIP("2001:7fe::53"),
+	net.ParseIP("192.58.128.30"),
+	net.ParseIP("2001:503:c27::2:30"),
+	net.ParseIP("193.0.14.129"),
+	net.ParseIP("2001:7fd::1"),
+	net.ParseIP("199.7.83.42"),
+	net.ParseIP("2001:500:9f::42"),
+	net.ParseIP("202.12.27.33"),
+	net.ParseIP("2001:dc3::35"),
+}
+
+// primeRetryInterval is how long to wait before priming again after a
+// priming query failed.
+const primeRetryInterval = time.Minute
+
+type rootServers struct {
+	ips []net.IP
+	mu  sync.RWMutex
+}
+
+func (rs *rootServers) get() []net.IP {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	return orderAddresses(rs.ips)
+}
+
+func (rs *rootServers) set(ips []net.IP) {
+	rs.mu.Lock()
+	rs.ips = slices.Clone(ips)
+	rs.mu.Unlock()
+}
+
+// parseRootHints reads root server addresses from a hints file in the
+// format of named.root. Only the NS records of the root zone and the A and
+// AAAA records of the servers they name are used.
+func parseRootHints(r io.Reader) ([]net.IP, error) {
+	nameservers := make([]string, 0)
+	addrs := make(map[string][]net.IP)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), ";")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		i := slices.IndexFunc(fields, func(f string) bool {
+			f = strings.ToUpper(f)
+			return f == "NS" || f == "A" || f == "AAAA"
+		})
+		if i < 1 || i != len(fields)-2 {
+			return nil, fmt.Errorf("Invalid root hints record on line %d", line)
+		}
+		name := canonicalName(fields[0])
+		rdata := fields[i+1]
+		switch strings.ToUpper(fields[i]) {
+		case "NS":
+			if name == "." {
+				nameservers = append(nameservers, canonicalName(rdata))
+			}
+		case "A", "AAAA":
+			ip := net.ParseIP(rdata)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid address %q on line %d", rdata, line)
+			}
+			addrs[name] = append(addrs[name], ip)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0)
+	for _, ns := range nameservers {
+		ips = append(ips, addrs[ns]...)
+	}
+	if len(ips) == 0 {
+		return nil, errors.New("Root hints contain no root server addresses")
+	}
+	return ips, nil
+}
+
+func loadRootHints(path string) ([]net.IP, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseRootHints(f)
+}
+
+func (r *Resolver) getRootNameservers() []net.IP {
+	return r.roots.get()
+}
+
+// Prime refreshes the set of root servers as described in RFC 8109, by
+// asking the currently known root servers for the NS records of the root
+// zone. The response is cached and its addresses replace the root servers
+// used once the cached delegation expires.
+func (r *Resolver) Prime(ctx context.Context) error {
+	msg, err := r.queryNameservers(ctx, ".", parser.RTNS, parser.RCIN, r.getRootNameservers(), nil, false)
+	if err != nil {
+		return err
+	}
+	msg, _, err = sanitizeResponse(msg, ".", ".")
+	if err != nil {
+		return err
+	}
+	ips, _ := getNameservers(parser.DNSMessage{Authorities: msg.Answers, Additionals: msg.Additionals})
+	if len(ips) == 0 {
+		return errors.New("Priming response contains no root server addresses")
+	}
+	r.cacheMessage(msg)
+	r.roots.set(ips)
+	r.logger.Info("Primed root servers", zap.Int("Addresses", len(ips)))
+	return nil
+}
+
+func (r *Resolver) primePeriodically(ctx context.Context, interval time.Duration) {
+	for {
+		wait := interval
+		if err := r.Prime(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			r.logger.Warn("Priming failed", zap.Error(err))
+			wait = min(interval, primeRetryInterval)
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package resolver
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+const testRootHints = `;       This file holds the information on root name servers needed to
+;       initialize cache of Internet domain name servers
+;
+.                        3600000      NS    A.ROOT-SERVERS.NET.
+A.ROOT-SERVERS.NET.      3600000      A     198.41.0.4
+A.ROOT-SERVERS.NET.      3600000      AAAA  2001:503:ba3e::2:30
+;
+.                        3600000      NS    B.ROOT-SERVERS.NET.
+B.ROOT-SERVERS.NET.      3600000  IN  A     170.247.170.2
+; End of file
+`
+
+func TestParseRootHints(t *testing.T) {
+	tests := []struct {
+		name      string
+		hints     string
+		expectIPs []string
+		expectErr bool
+	}{
+		{"named.root", testRootHints, []string{"198.41.0.4", "2001:503:ba3e::2:30", "170.247.170.2"}, false},
+		{"address without NS", "a.root-servers.net. 3600000 A 198.41.0.4\n", nil, true},
+		{"invalid address", ". 3600000 NS a.root-servers.net.\na.root-servers.net. 3600000 A 198.41.0\n", nil, true},
+		{"unsupported record", ". 3600000 SOA a.root-servers.net. nstld.verisign-grs.com.\n", nil, true},
+		{"empty", "", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ips, err := parseRootHints(strings.NewReader(tt.hints))
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("expected error %v, got %v", tt.expectErr, err)
+			}
+			if len(ips) != len(tt.expectIPs) {
+				t.Fatalf("expected %v, got %v", tt.expectIPs, ips)
+			}
+			for i, ip := range ips {
+				if !ip.Equal(net.ParseIP(tt.expectIPs[i])) {
+					t.Errorf("expected %v, got %v", tt.expectIPs[i], ip)
+				}
+			}
+		})
+	}
+}
+
+func TestBuiltinRootHints(t *testing.T) {
+	var v4, v6 int
+	for _, ip := range builtinRootHints {
+		if ip == nil {
+			t.Fatal("invalid built-in root hint")
+		}
+		if ip.To4() != nil {
+			v4++
+		} else {
+			v6++
+		}
+	}
+	if v4 != 13 || v6 != 13 {
+		t.Errorf("expected 13 IPv4 and 13 IPv6 root addresses, got %d and %d", v4, v6)
+	}
+}
+
+func TestRootServers_Get(t *testing.T) {
+	rs := &rootServers{ips: builtinRootHints}
+	ips := rs.get()
+	if len(ips) != len(builtinRootHints) {
+		t.Fatalf("expected %d addresses, got %d", len(builtinRootHints), len(ips))
+	}
+	for _, ip := range ips[:13] {
+		if ip.To4() == nil {
+			t.Errorf("expected IPv4 root servers first, got %v", ips)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package resolver
+
+import (
+	"cmp"
+	"math/rand"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// initialRTT is assumed for servers that have not answered yet, so
+	// that they are tried ahead of servers known to be slow.
+	initialRTT = 200 * time.Millisecond
+	maxRTT     = 10 * time.Second
+	// Servers that fail are not preferred again until a backoff starting
+	// at minBackoff, and doubling with each consecutive failure, has passed.
+	minBackoff = time.Second
+	maxBackoff = 5 * time.Minute
+	// exploreRate is the chance of trying a server other than the fastest
+	// first, so that estimates for the others stay up to date.
+	exploreRate       = 0.05
+	maxTrackedServers = 10000
+)
+
+type serverStats struct {
+	srtt         time.Duration
+	failures     int
+	backoffUntil time.Time
+}
+
+// nameserverStats tracks the smoothed round trip time and failures of each
+// nameserver address queried, to pick the fastest responsive server.
+type nameserverStats struct {
+	servers map[string]*serverStats
+	mu      sync.Mutex
+}
+
+func (ns *nameserverStats) get(ip net.IP) *serverStats {
+	k := ip.String()
+	s, ok := ns.servers[k]
+	if !ok {
+		if len(ns.servers) >= maxTrackedServers {
+			for old := range ns.servers {
+				delete(ns.servers, old)
+				break
+			}
+		}
+		s = &serverStats{}
+		ns.servers[k] = s
+	}
+	return s
+}
+
+// RecordRTT updates the smoothed RTT of ip with a new sample, using the same
+// weighting as TCP's SRTT in RFC 6298.
+func (ns *nameserverStats) RecordRTT(ip net.IP, rtt time.Duration) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	s := ns.get(ip)
+	if s.srtt == 0 {
+		s.srtt = rtt
+	} else {
+		s.srtt = (7*s.srtt + rtt) / 8
+	}
+	s.failures = 0
+	s.backoffUntil = time.Time{}
+}
+
+// RecordFailure backs off ip after a failed query. A timeout also doubles
+// its smoothed RTT so that it falls behind servers that do answer.
+func (ns *nameserverStats) RecordFailure(ip net.IP, timeout bool) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	s := ns.get(ip)
+	if timeout {
+		s.srtt = min(2*max(s.srtt, initialRTT), maxRTT)
+	}
+	s.failures++
+	backoff := maxBackoff
+	if s.failures < 16 {
+		backoff = min(minBackoff<<(s.failures-1), maxBackoff)
+	}
+	s.backoffUntil = time.Now().Add(backoff)
+}
+
+// Order sorts ips by smoothed RTT, with servers still backing off after a
+// failure placed last. Servers without a measured RTT keep their relative
+// order. Occasionally a random responsive server is moved to the front.
+func (ns *nameserverStats) Order(ips []net.IP) []net.IP {
+	type candidate struct {
+		ip        net.IP
+		srtt      time.Duration
+		backedOff bool
+	}
+	now := time.Now()
+	candidates := make([]candidate, len(ips))
+	ns.mu.Lock()
+	for i, ip := range ips {
+		c := candidate{ip: ip, srtt: initialRTT}
+		if s, ok := ns.servers[ip.String()]; ok {
+			if s.srtt > 0 {
+				c.srtt = s.srtt
+			}
+			c.backedOff = now.Before(s.backoffUntil)
+		}
+		candidates[i] = c
+	}
+	ns.mu.Unlock()
+
+	slices.SortStableFunc(candidates, func(a, b candidate) int {
+		if a.backedOff != b.backedOff {
+			if a.backedOff {
+				return 1
+			}
+			return -1
+		}
+		return cmp.Compare(a.srtt, b.srtt)
+	})
+	responsive := slices.IndexFunc(candidates, func(c candidate) bool { return c.backedOff })
+	if responsive == -1 {
+		responsive = len(candidates)
+	}
+	if responsive > 1 && rand.Float64() < exploreRate {
+		i := 1 + rand.Intn(responsive-1)
+		candidates[0], candidates[i] = candidates[i], candidates[0]
+	}
+	res := make([]net.IP, len(candidates))
+	for i, c := range candidates {
+		res[i] = c.ip
+	}
+	return res
+}
+
+func newNameserverStats() *nameserverStats {
+	return &nameserverStats{servers: make(map[string]*serverStats)}
+}
@@ -0,0 +1,87 @@
+package resolver
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNameserverStats_RecordRTT(t *testing.T) {
+	ns := newNameserverStats()
+	ip := net.IPv4(192, 0, 2, 1)
+
+	ns.RecordRTT(ip, 80*time.Millisecond)
+	ns.RecordRTT(ip, 160*time.Millisecond)
+
+	s := ns.servers[ip.String()]
+	if s.srtt != 90*time.Millisecond {
+		t.Errorf("expected SRTT 90ms, got %v", s.srtt)
+	}
+}
+
+func TestNameserverStats_RecordFailure(t *testing.T) {
+	tests := []struct {
+		name        string
+		timeout     bool
+		failures    int
+		expectSRTT  time.Duration
+		expectDelay time.Duration
+	}{
+		{"single timeout", true, 1, 400 * time.Millisecond, minBackoff},
+		{"repeated timeouts", true, 3, 1600 * time.Millisecond, 4 * minBackoff},
+		{"refused", false, 1, 50 * time.Millisecond, minBackoff},
+		{"backoff capped", false, 20, 50 * time.Millisecond, maxBackoff},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ns := newNameserverStats()
+			ip := net.IPv4(192, 0, 2, 1)
+			ns.RecordRTT(ip, 50*time.Millisecond)
+			for range tt.failures {
+				ns.RecordFailure(ip, tt.timeout)
+			}
+
+			s := ns.servers[ip.String()]
+			if s.srtt != tt.expectSRTT {
+				t.Errorf("expected SRTT %v, got %v", tt.expectSRTT, s.srtt)
+			}
+			delay := time.Until(s.backoffUntil)
+			if delay > tt.expectDelay || delay < tt.expectDelay-time.Second {
+				t.Errorf("expected backoff of %v, got %v", tt.expectDelay, delay)
+			}
+
+			ns.RecordRTT(ip, 50*time.Millisecond)
+			if s.failures != 0 || !s.backoffUntil.IsZero() {
+				t.Error("expected a response to clear the backoff")
+			}
+		})
+	}
+}
+
+func TestNameserverStats_Order(t *testing.T) {
+	ns := newNameserverStats()
+	fast := net.IPv4(192, 0, 2, 1)
+	slow := net.IPv4(192, 0, 2, 2)
+	unknown := net.IPv4(192, 0, 2, 3)
+	failed := net.IPv4(192, 0, 2, 4)
+	ns.RecordRTT(fast, 20*time.Millisecond)
+	ns.RecordRTT(slow, 400*time.Millisecond)
+	ns.RecordRTT(failed, 10*time.Millisecond)
+	ns.RecordFailure(failed, true)
+
+	counts := make(map[string]int)
+	for range 1000 {
+		ips := ns.Order([]net.IP{failed, slow, unknown, fast})
+		if !ips[len(ips)-1].Equal(failed) {
+			t.Fatalf("expected backed off server last, got %v", ips)
+		}
+		counts[ips[0].String()]++
+	}
+	if counts[fast.String()] < 900 {
+		t.Errorf("expected fastest server to be preferred, got %v", counts)
+	}
+	if counts[fast.String()] == 1000 {
+		t.Errorf("expected other servers to be explored, got %v", counts)
+	}
+}
@@ -0,0 +1,94 @@
+package resolver
+
+import (
+	"dns/internal/parser"
+	"dns/internal/zone"
+	"net"
+)
+
+type RuleType int
+
+const (
+	// ForwardRule sends recursive queries for names in the zone to the
+	// rule's servers.
+	ForwardRule RuleType = iota
+	// StubRule starts iteration for names in the zone at the rule's servers,
+	// which are authoritative for it.
+	StubRule
+)
+
+func (rt RuleType) String() string {
+	switch rt {
+	case ForwardRule:
+		return "forward"
+	case StubRule:
+		return "stub"
+	}
+	return "unknown"
+}
+
+// Rule overrides how names at or below Zone are resolved.
+type Rule struct {
+	Zone    string
+	Type    RuleType
+	Servers []net.IP
+}
+
+// getRules indexes rules by zone. Global forwarders are treated as a forward
+// rule for the root zone, unless a rule for the root zone is configured.
+func getRules(config Config) map[string]Rule {
+	rules := make(map[string]Rule)
+	if len(config.Forwarders) > 0 {
+		rules["."] = Rule{Zone: ".", Type: ForwardRule, Servers: config.Forwarders}
+	}
+	for _, rule := range config.Rules {
+		rule.Zone = canonicalName(rule.Zone)
+		rules[rule.Zone] = rule
+	}
+	return rules
+}
+
+// getRule returns the rule for the closest zone enclosing domain.
+func (r *Resolver) getRule(domain string) (Rule, bool) {
+	for zone := canonicalName(domain); zone != ""; zone = getParentZone(zone) {
+		if rule, ok := r.rules[zone]; ok {
+			return rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+func getZones(config Config) map[string]*zone.Zone {
+	zones := make(map[string]*zone.Zone)
+	for _, z := range config.Zones {
+		zones[z.Origin] = z
+	}
+	return zones
+}
+
+// getZone returns the closest zone enclosing domain that we serve
+// authoritatively.
+func (r *Resolver) getZone(domain string, qclass parser.RecordClass) (*zone.Zone, bool) {
+	for name := canonicalName(domain); name != ""; name = getParentZone(name) {
+		if z, ok := r.zones[name]; ok && z.Class == qclass {
+			return z, true
+		}
+	}
+	return nil, false
+}
+
+// getZoneDelegation returns the servers that a zone we serve delegates
+// domain to, when domain lies below one of its zone cuts.
+func (r *Resolver) getZoneDelegation(domain string, qclass parser.RecordClass) ([]net.IP, []string, string, bool) {
+	z, ok := r.getZone(domain, qclass)
+	if !ok {
+		return nil, nil, "", false
+	}
+	a := z.Lookup(domain, parser.RTNS)
+	if a.Authoritative || len(a.Authorities) == 0 {
+		return nil, nil, "", false
+	}
+	msg := parser.DNSMessage{Authorities: a.Authorities, Additionals: a.Additionals}
+	ips, names := getNameservers(msg)
+	return ips, names, getReferralZone(msg), true
+}
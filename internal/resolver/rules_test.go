@@ -0,0 +1,282 @@
+package resolver
+
+import (
+	"dns/internal/parser"
+	"dns/internal/zone"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestGetRule(t *testing.T) {
+	upstream := net.IPv4(192, 0, 2, 1)
+	internal := net.IPv4(10, 0, 0, 53)
+	lab := net.IPv4(10, 1, 0, 53)
+	r := NewResolver(zap.NewNop(), Config{
+		Forwarders: []net.IP{upstream},
+		Rules: []Rule{
+			{Zone: "Corp.Example", Type: ForwardRule, Servers: []net.IP{internal}},
+			{Zone: "lab.corp.example.", Type: StubRule, Servers: []net.IP{lab}},
+		},
+	})
+
+	tests := []struct {
+		domain       string
+		expectZone   string
+		expectType   RuleType
+		expectServer net.IP
+	}{
+		{"www.example.com.", ".", ForwardRule, upstream},
+		{"corp.example.", "corp.example.", ForwardRule, internal},
+		{"WIKI.corp.example.", "corp.example.", ForwardRule, internal},
+		{"host.lab.corp.example.", "lab.corp.example.", StubRule, lab},
+		{"notcorp.example.", ".", ForwardRule, upstream},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			rule, ok := r.getRule(tt.domain)
+			if !ok {
+				t.Fatal("expected a rule to match")
+			}
+			if rule.Zone != tt.expectZone || rule.Type != tt.expectType || !rule.Servers[0].Equal(tt.expectServer) {
+				t.Errorf("expected %s rule for %s, got %v", tt.expectType, tt.expectZone, rule)
+			}
+		})
+	}
+}
+
+func TestGetRule_NoForwarders(t *testing.T) {
+	r := NewResolver(zap.NewNop(), Config{
+		Rules: []Rule{{Zone: "corp.example.", Type: StubRule, Servers: []net.IP{net.IPv4(10, 0, 0, 53)}}},
+	})
+
+	if _, ok := r.getRule("www.example.com."); ok {
+		t.Error("expected names outside rule zones to be resolved from the root")
+	}
+	if _, ok := r.getRule("corp.example."); !ok {
+		t.Error("expected rule for the zone apex")
+	}
+}
+
+func TestGetRules_RootRuleOverridesForwarders(t *testing.T) {
+	rules := getRules(Config{
+		Forwarders: []net.IP{net.IPv4(192, 0, 2, 1)},
+		Rules:      []Rule{{Zone: ".", Type: StubRule, Servers: []net.IP{net.IPv4(10, 0, 0, 53)}}},
+	})
+
+	if rule := rules["."]; rule.Type != StubRule {
+		t.Errorf("expected configured root rule to win, got %v", rule)
+	}
+}
+
+func TestIterate_Rules(t *testing.T) {
+	setTestPort(t)
+	var mu sync.Mutex
+	recursive := make(map[string]bool)
+	servers := map[string]string{
+		"127.0.0.2": "192.0.2.2", // forwarder for corp.example.
+		"127.0.0.3": "192.0.2.3", // stub server for lab.example.
+		"127.0.0.4": "192.0.2.4", // public server for lab.example.
+		"127.0.0.5": "192.0.2.5", // server for sub.lab.example.
+	}
+	for ns, answer := range servers {
+		startTestNameserver(t, net.ParseIP(ns), func(q parser.DNSMessage) parser.DNSMessage {
+			mu.Lock()
+			recursive[ns] = q.Header.GetRD()
+			mu.Unlock()
+			return answerA(answer)(q)
+		})
+	}
+	rules := []Rule{
+		{Zone: "corp.example.", Type: ForwardRule, Servers: []net.IP{net.IPv4(127, 0, 0, 2)}},
+		{Zone: "lab.example.", Type: StubRule, Servers: []net.IP{net.IPv4(127, 0, 0, 3)}},
+	}
+
+	tests := []struct {
+		name         string
+		domain       string
+		delegation   []parser.DNSResourceRecord
+		expectServer string
+		expectRD     bool
+	}{
+		{
+			name:         "forward zone",
+			domain:       "host.corp.example.",
+			expectServer: "127.0.0.2",
+			expectRD:     true,
+		},
+		{
+			name:         "stub zone",
+			domain:       "host.lab.example.",
+			expectServer: "127.0.0.3",
+		},
+		{
+			name:   "stub servers override cached public delegation",
+			domain: "host.lab.example.",
+			delegation: []parser.DNSResourceRecord{
+				makeNSRecord("lab.example.", "ns.public.example."),
+				makeGlue("ns.public.example.", net.IPv4(127, 0, 0, 4)),
+			},
+			expectServer: "127.0.0.3",
+		},
+		{
+			name:   "cached delegation below stub zone",
+			domain: "host.sub.lab.example.",
+			delegation: []parser.DNSResourceRecord{
+				makeNSRecord("sub.lab.example.", "ns.sub.lab.example."),
+				makeGlue("ns.sub.lab.example.", net.IPv4(127, 0, 0, 5)),
+			},
+			expectServer: "127.0.0.5",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			clear(recursive)
+			mu.Unlock()
+			cfg := testConfig()
+			cfg.Rules = rules
+			r := NewResolver(zap.NewNop(), cfg)
+			defer r.Close()
+			r.cache.Add(tt.delegation)
+
+			answers, err := r.Resolve(tt.domain, parser.RTA, parser.RCIN)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(answers) != 1 || answers[0].RData.String() != servers[tt.expectServer] {
+				t.Errorf("expected answer from %s, got %v", tt.expectServer, answers)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			rd, ok := recursive[tt.expectServer]
+			if !ok || len(recursive) != 1 {
+				t.Errorf("expected only %s to be queried, got %v", tt.expectServer, recursive)
+			}
+			if rd != tt.expectRD {
+				t.Errorf("expected RD %v, got %v", tt.expectRD, rd)
+			}
+		})
+	}
+}
+
+func TestResolveQuery_FromZone(t *testing.T) {
+	z, err := zone.Parse(strings.NewReader("$TTL 3600\n@ SOA ns1 hostmaster 1 2 3 4 300\n@ NS ns1\nns1 A 192.0.2.1\n"), "corp.example.", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r := NewResolver(zap.NewNop(), Config{Zones: []*zone.Zone{z}})
+
+	tests := []struct {
+		qname         string
+		expectRCode   parser.RCode
+		expectAnswers int
+	}{
+		{"ns1.corp.example.", parser.NoError, 1},
+		{"missing.corp.example.", parser.NXDomain, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.qname, func(t *testing.T) {
+			q := parser.DNSMessage{
+				Header:    parser.DNSHeader{ID: 42, QDCount: 1},
+				Questions: []parser.DNSQuestion{{QName: tt.qname, QType: parser.RTA, QClass: parser.RCIN}},
+			}
+			m, err := r.ResolveQuery(q)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !m.Header.GetAA() || m.Header.ID != 42 {
+				t.Errorf("expected authoritative response to query 42, got %v", m.Header)
+			}
+			if m.GetRCode() != tt.expectRCode || len(m.Answers) != tt.expectAnswers {
+				t.Errorf("expected %v with %d answers, got %v", tt.expectRCode, tt.expectAnswers, m)
+			}
+		})
+	}
+
+	if _, ok := r.getZone("www.example.com.", parser.RCIN); ok {
+		t.Error("expected names outside the zone not to match")
+	}
+	if _, ok := r.getZone("ns1.corp.example.", parser.RCCH); ok {
+		t.Error("expected zone to only match its own class")
+	}
+}
+
+func TestResolve_FromZone(t *testing.T) {
+	setTestPort(t)
+	startTestNameserver(t, net.IPv4(127, 0, 0, 2), func(q parser.DNSMessage) parser.DNSMessage {
+		alias := makeCNameRecord(q.Questions[0].QName, "ns1.corp.example.")
+		return parser.CreateResponseMessage(q, parser.NoError, []parser.DNSResourceRecord{alias}, nil)
+	})
+	startTestNameserver(t, net.IPv4(127, 0, 0, 6), answerA("192.0.2.6"))
+	z, err := zone.Parse(strings.NewReader(`$TTL 3600
+@ SOA ns1 hostmaster 1 2 3 4 300
+@ NS ns1
+ns1 A 192.0.2.1
+sub NS ns.sub
+ns.sub A 127.0.0.6
+pinned A 192.0.2.7
+`), "corp.example.", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ld := NewLocalData(300)
+	ld.AddNXDomain("pinned.corp.example.")
+	cfg := testConfig()
+	cfg.Zones = []*zone.Zone{z}
+	cfg.Forwarders = []net.IP{net.IPv4(127, 0, 0, 2)}
+	cfg.LocalData = ld
+	r := NewResolver(zap.NewNop(), cfg)
+	defer r.Close()
+
+	tests := []struct {
+		name     string
+		domain   string
+		expectNX bool
+		expectIP string
+	}{
+		{"name in zone", "ns1.corp.example.", false, "192.0.2.1"},
+		{"alias into zone", "alias.example.", false, "192.0.2.1"},
+		{"name below zone cut", "host.sub.corp.example.", false, "192.0.2.6"},
+		{"missing name", "missing.corp.example.", true, ""},
+		{"local data over zone", "pinned.corp.example.", true, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			answers, err := r.Resolve(tt.domain, parser.RTA, parser.RCIN)
+			if tt.expectNX {
+				var nxErr parser.NXDomainError
+				if !errors.As(err, &nxErr) {
+					t.Errorf("expected NXDOMAIN error, got %v, %v", answers, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(answers) == 0 || answers[len(answers)-1].RData.String() != tt.expectIP {
+				t.Errorf("expected %s, got %v", tt.expectIP, answers)
+			}
+		})
+	}
+
+	q := parser.DNSMessage{
+		Header:    parser.DNSHeader{ID: 42, QDCount: 1},
+		Questions: []parser.DNSQuestion{{QName: "pinned.corp.example.", QType: parser.RTA, QClass: parser.RCIN}},
+	}
+	m, err := r.ResolveQuery(q)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m.GetRCode() != parser.NXDomain || len(m.Answers) != 0 {
+		t.Errorf("expected local NXDOMAIN to win over the zone, got %v", m)
+	}
+}
@@ -0,0 +1,152 @@
+package resolver
+
+import (
+	"bufio"
+	"dns/internal/parser"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// A cache snapshot starts with snapshotMagic, followed by one record per
+// cache entry:
+//
+//	expiry  uint64, Unix seconds at which the entry expires
+//	length  uint16, length of the message that follows
+//	message DNS response in wire format
+//
+// The question of the message is the cache key. Positive entries hold the
+// RRset in the answer section, negative entries hold the SOA in the
+// authority section along with the cached RCODE.
+var snapshotMagic = []byte("DNSCACHE\x01")
+
+func createSnapshotMessage(e *cacheEntry) parser.DNSMessage {
+	q := parser.DNSMessage{
+		Header: parser.DNSHeader{QDCount: 1},
+		Questions: []parser.DNSQuestion{
+			{QName: e.key.Name, QType: e.key.Type, QClass: e.key.Class},
+		},
+	}
+	if e.negative {
+		return parser.CreateResponseMessage(q, e.neg.rcode, nil, []parser.DNSResourceRecord{e.neg.soa})
+	}
+	return parser.CreateResponseMessage(q, parser.NoError, e.rrset.records, nil)
+}
+
+// Dump writes every unexpired entry in the cache to w.
+func (c *cache) Dump(w io.Writer) error {
+	now := time.Now()
+	c.mu.Lock()
+	records := make([][]byte, 0, c.lru.Len())
+	// Walk from the least recently used end so that loading the snapshot
+	// restores the same LRU order.
+	for elem := c.lru.Back(); elem != nil; elem = elem.Prev() {
+		e := elem.Value.(*cacheEntry)
+		if !now.Before(e.expiry()) {
+			continue
+		}
+		data := parser.SerializeDNSMessage(createSnapshotMessage(e))
+		if len(data) > parser.MaxTCPSize {
+			continue
+		}
+		record := binary.BigEndian.AppendUint64(nil, uint64(e.expiry().Unix()))
+		record = binary.BigEndian.AppendUint16(record, uint16(len(data)))
+		records = append(records, append(record, data...))
+	}
+	c.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(snapshotMagic); err != nil {
+		return err
+	}
+	for _, record := range records {
+		if _, err := bw.Write(record); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// Load adds the entries in a snapshot read from r to the cache, with their
+// TTLs reduced by the time passed since they were written. Entries that
+// have expired since or that cannot be parsed are skipped. It returns the
+// number of entries loaded.
+func (c *cache) Load(r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return 0, err
+	}
+	if string(magic) != string(snapshotMagic) {
+		return 0, errors.New("Not a cache snapshot")
+	}
+	loaded := 0
+	header := make([]byte, 10)
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			if errors.Is(err, io.EOF) {
+				return loaded, nil
+			}
+			return loaded, err
+		}
+		expiry := time.Unix(int64(binary.BigEndian.Uint64(header)), 0)
+		data := make([]byte, binary.BigEndian.Uint16(header[8:]))
+		if _, err := io.ReadFull(br, data); err != nil {
+			return loaded, err
+		}
+		ttl := getRemainingTTL(expiry, time.Now())
+		if ttl == 0 {
+			continue
+		}
+		m, err := parser.ParseDNSMessage(data, parser.Response)
+		if err == nil && len(m.Questions) != 1 {
+			err = errors.New("Expected exactly one question")
+		}
+		if err != nil {
+			c.logger.Warn("Skipping malformed cache snapshot entry", zap.Error(err))
+			continue
+		}
+		if len(m.Answers) > 0 {
+			setTTL(m.Answers, ttl)
+			c.Add(m.Answers)
+		} else if soa, ok := getSOA(m.Authorities); ok {
+			q := m.Questions[0]
+			soa.TTL = ttl
+			c.AddNegative(cacheKey{q.QName, q.QType, q.QClass}, m.GetRCode(), soa)
+		}
+		loaded++
+	}
+}
+
+// SaveCache writes a snapshot of the cache to path. The snapshot is written
+// to a temporary file first so that a crash never leaves a partial file.
+func (r *Resolver) SaveCache(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := r.cache.Dump(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// LoadCache warms the cache from a snapshot written by SaveCache.
+func (r *Resolver) LoadCache(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return r.cache.Load(f)
+}
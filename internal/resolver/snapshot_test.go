@@ -0,0 +1,125 @@
+package resolver
+
+import (
+	"bytes"
+	"dns/internal/parser"
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestCache_DumpAndLoad(t *testing.T) {
+	src := NewCache(zap.NewNop(), CacheConfig{})
+	aKey := cacheKey{Name: "www.example.com.", Type: parser.RTA, Class: parser.RCIN}
+	nsKey := cacheKey{Name: "example.com.", Type: parser.RTNS, Class: parser.RCIN}
+	negKey := cacheKey{Name: "missing.example.com.", Type: parser.RTA, Class: parser.RCIN}
+	expiredKey := cacheKey{Name: "old.example.com.", Type: parser.RTA, Class: parser.RCIN}
+
+	src.Add([]parser.DNSResourceRecord{makeARecord(aKey.Name, 300), makeARecord(aKey.Name, 300)})
+	src.Add([]parser.DNSResourceRecord{makeNSRecord("example.com.", "ns1.example.com.")})
+	src.AddNegative(negKey, parser.NXDomain, makeSOARecord("example.com.", 600, 120))
+	src.Add([]parser.DNSResourceRecord{makeARecord(expiredKey.Name, 1)})
+	time.Sleep(1100 * time.Millisecond)
+
+	var buf bytes.Buffer
+	if err := src.Dump(&buf); err != nil {
+		t.Fatalf("unexpected dump error: %v", err)
+	}
+
+	dst := NewCache(zap.NewNop(), CacheConfig{})
+	n, err := dst.Load(&buf)
+	if err != nil {
+		t.Fatalf("unexpected load error: %v", err)
+	}
+	if n != 3 {
+		t.Errorf("expected 3 entries loaded, got %d", n)
+	}
+
+	got, ok := dst.Get(aKey)
+	if !ok || len(got) != 2 {
+		t.Fatalf("expected 2 A records, got %v", got)
+	}
+	if got[0].TTL > 299 || got[0].TTL < 290 {
+		t.Errorf("expected TTL reduced by elapsed time, got %d", got[0].TTL)
+	}
+	if _, ok := dst.Get(nsKey); !ok {
+		t.Error("expected NS RRset to be loaded")
+	}
+	entry, ok := dst.GetNegative(negKey)
+	if !ok || entry.rcode != parser.NXDomain {
+		t.Fatalf("expected NXDOMAIN negative entry, got %v", entry)
+	}
+	if entry.soa.TTL > 119 {
+		t.Errorf("expected negative TTL reduced by elapsed time, got %d", entry.soa.TTL)
+	}
+	if _, ok := dst.Get(expiredKey); ok {
+		t.Error("expected expired entry not to be loaded")
+	}
+}
+
+func TestCache_LoadRejectsInvalidSnapshot(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"bad magic", []byte("NOTACACHE")},
+		{"truncated entry", append(append([]byte(nil), snapshotMagic...), 0, 0, 0, 0)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCache(zap.NewNop(), CacheConfig{})
+			if _, err := c.Load(bytes.NewReader(tt.data)); err == nil {
+				t.Error("expected error loading invalid snapshot")
+			}
+		})
+	}
+}
+
+func TestCache_LoadSkipsMalformedEntry(t *testing.T) {
+	src := NewCache(zap.NewNop(), CacheConfig{})
+	src.Add([]parser.DNSResourceRecord{makeARecord("www.example.com.", 300)})
+	var buf bytes.Buffer
+	if err := src.Dump(&buf); err != nil {
+		t.Fatalf("unexpected dump error: %v", err)
+	}
+
+	expiry := uint64(time.Now().Add(time.Hour).Unix())
+	garbage := []byte{0xde, 0xad, 0xbe, 0xef}
+	snapshot := append([]byte(nil), snapshotMagic...)
+	snapshot = binary.BigEndian.AppendUint64(snapshot, expiry)
+	snapshot = binary.BigEndian.AppendUint16(snapshot, uint16(len(garbage)))
+	snapshot = append(snapshot, garbage...)
+	snapshot = append(snapshot, buf.Bytes()[len(snapshotMagic):]...)
+
+	dst := NewCache(zap.NewNop(), CacheConfig{})
+	n, err := dst.Load(bytes.NewReader(snapshot))
+	if err != nil {
+		t.Fatalf("unexpected load error: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 entry loaded, got %d", n)
+	}
+	if _, ok := dst.Get(cacheKey{Name: "www.example.com.", Type: parser.RTA, Class: parser.RCIN}); !ok {
+		t.Error("expected the entry after the malformed one to be loaded")
+	}
+}
+
+func TestResolver_SaveAndLoadCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+	src := NewResolver(zap.NewNop(), testConfig())
+	src.cache.Add([]parser.DNSResourceRecord{makeARecord("www.example.com.", 300)})
+	if err := src.SaveCache(path); err != nil {
+		t.Fatalf("unexpected save error: %v", err)
+	}
+
+	dst := NewResolver(zap.NewNop(), testConfig())
+	n, err := dst.LoadCache(path)
+	if err != nil || n != 1 {
+		t.Fatalf("expected 1 entry loaded, got %d, %v", n, err)
+	}
+}
@@ -1,9 +1,14 @@
 package server
 
 import (
+	"context"
+	"dns/internal/parser"
 	"errors"
-	"fmt"
+	"io"
+	"math/rand/v2"
 	"net"
+	"strconv"
+	"time"
 )
 
 type Protocol int
@@ -13,60 +18,124 @@ const (
 	TCP
 )
 
-func SendMessage(data []byte, host net.IP, protocol Protocol) ([]byte, error) {
+func WriteTCPMessage(w io.Writer, data []byte) error {
+	if len(data) > 0xFFFF {
+		return errors.New("Message too long for TCP framing")
+	}
+	length := uint16(len(data))
+	lengthBuf := []byte{byte(length >> 8), byte(length & 0xFF)}
+	_, err := w.Write(append(lengthBuf, data...))
+	return err
+}
+
+func ReadTCPMessage(r io.Reader) ([]byte, error) {
+	lengthPre := make([]byte, 2)
+	_, err := io.ReadFull(r, lengthPre)
+	if err != nil {
+		return nil, err
+	}
+	length := int(lengthPre[0])<<8 | int(lengthPre[1])
+	data := make([]byte, length)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// SendMessage sends data to host and waits for the response. Canceling ctx
+// aborts any in-flight network I/O, and its deadline bounds the exchange.
+// Responses that accept rejects are dropped and reading continues, so that
+// a spoofed reply cannot end the exchange (RFC 5452 section 9.1). A nil
+// accept takes the first response.
+func SendMessage(ctx context.Context, data []byte, host net.IP, protocol Protocol, accept func(resp []byte) bool) ([]byte, error) {
+	var network string
 	switch protocol {
 	case UDP:
-		addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%v:53", host))
-		if err != nil {
-			return nil, err
-		}
-		conn, err := net.DialUDP("udp", nil, addr)
-		if err != nil {
-			return nil, err
-		}
-		defer conn.Close()
-		_, err = conn.Write(data)
-		if err != nil {
-			return nil, err
-		}
-
-		resp := make([]byte, 512)
-		n, _, err := conn.ReadFromUDP(resp)
-		if err != nil {
-			return nil, err
-		}
-		return resp[:n], nil
+		network = "udp"
 	case TCP:
-		addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%v:53", host))
-		if err != nil {
-			return nil, err
-		}
-		conn, err := net.DialTCP("tcp", nil, addr)
-		if err != nil {
-			return nil, err
+		network = "tcp"
+	default:
+		return nil, errors.New("?")
+	}
+	conn, err := dial(ctx, network, host)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
 		}
-		defer conn.Close()
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
 
-		length := uint16(len(data))
-		lengthBuf := []byte{byte(length >> 8), byte(length & 0xFF)}
-		_, err = conn.Write(append(lengthBuf, data...))
-		if err != nil {
-			return nil, err
+	resp, err := exchange(conn, data, protocol, accept)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return resp, err
+}
+
+// Port is the port nameservers are queried on.
+var Port = 53
+
+const (
+	minSourcePort = 1024
+	maxSourcePort = 65535
+	portAttempts  = 3
+)
+
+// dial connects to Port on host. UDP queries are sent from a randomly
+// chosen source port so that off-path attackers have to guess it along with
+// the query ID to spoof a response.
+func dial(ctx context.Context, network string, host net.IP) (net.Conn, error) {
+	addr := net.JoinHostPort(host.String(), strconv.Itoa(Port))
+	if network == "udp" {
+		for i := 0; i < portAttempts; i++ {
+			d := net.Dialer{LocalAddr: &net.UDPAddr{Port: minSourcePort + rand.IntN(maxSourcePort-minSourcePort+1)}}
+			conn, err := d.DialContext(ctx, network, addr)
+			if err == nil || ctx.Err() != nil {
+				return conn, err
+			}
 		}
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, addr)
+}
 
-		lengthPre := make([]byte, 2)
-		_, err = conn.Read(lengthPre)
+func exchange(conn net.Conn, data []byte, protocol Protocol, accept func(resp []byte) bool) ([]byte, error) {
+	if protocol == TCP {
+		err := WriteTCPMessage(conn, data)
 		if err != nil {
 			return nil, err
 		}
-		respLength := int(lengthPre[0])<<8 | int(lengthPre[1])
-		resp := make([]byte, respLength)
-		_, err = conn.Read(resp)
+		for {
+			resp, err := ReadTCPMessage(conn)
+			if err != nil {
+				return nil, err
+			}
+			if accept == nil || accept(resp) {
+				return resp, nil
+			}
+		}
+	}
+	_, err := conn.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		resp := make([]byte, parser.EDNSUDPSize)
+		n, err := conn.Read(resp)
 		if err != nil {
 			return nil, err
 		}
-		return resp, nil
-	default:
-		return nil, errors.New("?")
+		if accept == nil || accept(resp[:n]) {
+			return resp[:n], nil
+		}
 	}
 }
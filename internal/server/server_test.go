@@ -0,0 +1,91 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCPMessage_RoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	first := []byte{0x12, 0x34, 0x01, 0x00}
+	second := []byte{0xab, 0xcd}
+
+	if err := WriteTCPMessage(&buf, first); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := WriteTCPMessage(&buf, second); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes()[:2], []byte{0x00, 0x04}) {
+		t.Errorf("expected length prefix 0x0004, got %v", buf.Bytes()[:2])
+	}
+
+	got, err := ReadTCPMessage(&buf)
+	if err != nil || !bytes.Equal(got, first) {
+		t.Fatalf("expected %v, got %v (err %v)", first, got, err)
+	}
+	got, err = ReadTCPMessage(&buf)
+	if err != nil || !bytes.Equal(got, second) {
+		t.Fatalf("expected %v, got %v (err %v)", second, got, err)
+	}
+}
+
+func TestReadTCPMessage_Truncated(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{0x00, 0x05, 0x01, 0x02})
+	if _, err := ReadTCPMessage(buf); err == nil {
+		t.Error("expected error for truncated message, got none")
+	}
+}
+
+func TestWriteTCPMessage_TooLong(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteTCPMessage(&buf, make([]byte, 0x10000)); err == nil {
+		t.Error("expected error for oversize message, got none")
+	}
+}
+
+func TestSendMessage_Canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := SendMessage(ctx, []byte{0x00}, net.IPv4(127, 0, 0, 1), UDP, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestSendMessage_DropsRejectedResponses(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+	old := Port
+	Port = conn.LocalAddr().(*net.UDPAddr).Port
+	defer func() { Port = old }()
+	go func() {
+		buf := make([]byte, 512)
+		_, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		conn.WriteToUDP([]byte{0xde, 0xad}, addr)
+		conn.WriteToUDP([]byte{0x12, 0x34}, addr)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	resp, err := SendMessage(ctx, []byte{0x12, 0x34}, net.IPv4(127, 0, 0, 1), UDP, func(resp []byte) bool {
+		return bytes.Equal(resp, []byte{0x12, 0x34})
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(resp, []byte{0x12, 0x34}) {
+		t.Errorf("expected the accepted response, got %v", resp)
+	}
+}
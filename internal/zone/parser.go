@@ -0,0 +1,524 @@
+package zone
+
+import (
+	"bufio"
+	"dns/internal/parser"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maxIncludeDepth bounds nested $INCLUDE directives so that a file including
+// itself cannot recurse forever.
+const maxIncludeDepth = 8
+
+type token struct {
+	text string
+	// escapedDot is set when the token holds a dot escaped as \. or \046,
+	// which would have to be a literal dot inside a label.
+	escapedDot bool
+}
+
+// decodeEscape decodes the escape sequence following the backslash at
+// data[i], either \DDD giving a byte in decimal or \X standing for X itself.
+// It returns the decoded byte and the index of the last byte of the escape.
+func decodeEscape(data []byte, i int, line int) (byte, int, error) {
+	if i+1 >= len(data) {
+		return 0, i, fmt.Errorf("Incomplete escape on line %d", line)
+	}
+	digits := 0
+	for digits < 3 && i+1+digits < len(data) && data[i+1+digits] >= '0' && data[i+1+digits] <= '9' {
+		digits++
+	}
+	switch digits {
+	case 0:
+		return data[i+1], i + 1, nil
+	case 3:
+		v, _ := strconv.Atoi(string(data[i+1 : i+4]))
+		if v > 255 {
+			return 0, i, fmt.Errorf("Escape \\%s out of range on line %d", data[i+1:i+4], line)
+		}
+		return byte(v), i + 3, nil
+	}
+	return 0, i, fmt.Errorf("Escape \\DDD needs three digits on line %d", line)
+}
+
+// entry is one logical line of a master file, which may span several
+// physical lines inside parentheses.
+type entry struct {
+	tokens     []token
+	blankOwner bool
+	line       int
+}
+
+// tokenize splits a master file into entries as described in RFC 1035
+// section 5.1, dropping comments and joining parenthesized lines.
+func tokenize(r io.Reader) ([]entry, error) {
+	data, err := io.ReadAll(bufio.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]entry, 0)
+	cur := entry{line: 1}
+	line, depth := 1, 0
+	startOfLine := true
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c == '\n':
+			line++
+			if depth == 0 {
+				if len(cur.tokens) > 0 {
+					entries = append(entries, cur)
+				}
+				cur = entry{line: line}
+				startOfLine = true
+			}
+			continue
+		case c == ';':
+			for i < len(data)-1 && data[i+1] != '\n' {
+				i++
+			}
+		case c == ' ' || c == '\t' || c == '\r':
+			if startOfLine && depth == 0 && len(cur.tokens) == 0 {
+				cur.blankOwner = true
+			}
+		case c == '(':
+			depth++
+		case c == ')':
+			if depth == 0 {
+				return nil, fmt.Errorf("Unbalanced parentheses on line %d", line)
+			}
+			depth--
+		case c == '"':
+			var sb strings.Builder
+			t := token{}
+			for i++; i < len(data) && data[i] != '"'; i++ {
+				b := data[i]
+				if b == '\\' {
+					if b, i, err = decodeEscape(data, i, line); err != nil {
+						return nil, err
+					}
+					t.escapedDot = t.escapedDot || b == '.'
+				} else if b == '\n' {
+					line++
+				}
+				sb.WriteByte(b)
+			}
+			if i == len(data) {
+				return nil, fmt.Errorf("Unterminated string on line %d", line)
+			}
+			t.text = sb.String()
+			cur.tokens = append(cur.tokens, t)
+		default:
+			var sb strings.Builder
+			t := token{}
+			for ; i < len(data); i++ {
+				b := data[i]
+				if strings.IndexByte(" \t\r\n;()\"", b) >= 0 {
+					i--
+					break
+				}
+				if b == '\\' {
+					if b, i, err = decodeEscape(data, i, line); err != nil {
+						return nil, err
+					}
+					t.escapedDot = t.escapedDot || b == '.'
+				}
+				sb.WriteByte(b)
+			}
+			t.text = sb.String()
+			cur.tokens = append(cur.tokens, t)
+		}
+		startOfLine = false
+	}
+	if depth > 0 {
+		return nil, errors.New("Unbalanced parentheses at end of file")
+	}
+	if len(cur.tokens) > 0 {
+		entries = append(entries, cur)
+	}
+	return entries, nil
+}
+
+var recordTypes = map[string]parser.RecordType{
+	"A":     parser.RTA,
+	"NS":    parser.RTNS,
+	"MD":    parser.RTMD,
+	"MF":    parser.RTMF,
+	"CNAME": parser.RTCNAME,
+	"SOA":   parser.RTSOA,
+	"MB":    parser.RTMB,
+	"MG":    parser.RTMG,
+	"MR":    parser.RTMR,
+	"PTR":   parser.RTPTR,
+	"HINFO": parser.RTHINFO,
+	"MINFO": parser.RTMINFO,
+	"MX":    parser.RTMX,
+	"TXT":   parser.RTTXT,
+	"AAAA":  parser.RTAAAA,
+}
+
+var recordClasses = map[string]parser.RecordClass{
+	"IN": parser.RCIN,
+	"CS": parser.RCCS,
+	"CH": parser.RCCH,
+	"HS": parser.RCHS,
+}
+
+// parseTTL parses a TTL in seconds, also accepting the unit suffixes (s, m,
+// h, d, w) used by BIND, as in 1h30m.
+func parseTTL(s string) (uint32, error) {
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(n), nil
+	}
+	var total, n uint64
+	digits := false
+	for _, c := range strings.ToLower(s) {
+		if c >= '0' && c <= '9' {
+			n = n*10 + uint64(c-'0')
+			digits = true
+			continue
+		}
+		unit := map[rune]uint64{'s': 1, 'm': 60, 'h': 3600, 'd': 86400, 'w': 604800}[c]
+		if unit == 0 || !digits {
+			return 0, fmt.Errorf("Invalid TTL %q", s)
+		}
+		total += n * unit
+		n, digits = 0, false
+	}
+	if digits || total > 0xFFFFFFFF {
+		return 0, fmt.Errorf("Invalid TTL %q", s)
+	}
+	return uint32(total), nil
+}
+
+type zoneParser struct {
+	origin string
+	// ttl is set by $TTL, and lastTTL is the last TTL given explicitly,
+	// which is the default when there is no $TTL.
+	ttl        uint32
+	hasTTL     bool
+	lastTTL    uint32
+	hasLastTTL bool
+	lastOwner  string
+	lastClass  parser.RecordClass
+	records    []parser.DNSResourceRecord
+}
+
+// absoluteName resolves a domain name from a master file against origin.
+func (p *zoneParser) absoluteName(t token) (string, error) {
+	name := t.text
+	if t.escapedDot {
+		return "", fmt.Errorf("Escaped dot in %q is not supported in domain names", name)
+	}
+	if name == "@" {
+		if p.origin == "" {
+			return "", errors.New("@ used without an origin")
+		}
+		return p.origin, nil
+	}
+	if strings.HasSuffix(name, ".") {
+		return name, nil
+	}
+	if p.origin == "" {
+		return "", fmt.Errorf("Relative name %q used without an origin", name)
+	}
+	if p.origin == "." {
+		return name + ".", nil
+	}
+	return name + "." + p.origin, nil
+}
+
+func (p *zoneParser) parseFile(path string, depth int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return p.parse(f, filepath.Dir(path), depth)
+}
+
+func (p *zoneParser) parse(r io.Reader, dir string, depth int) error {
+	entries, err := tokenize(r)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := p.parseEntry(e, dir, depth); err != nil {
+			return fmt.Errorf("Line %d: %w", e.line, err)
+		}
+	}
+	return nil
+}
+
+func (p *zoneParser) parseEntry(e entry, dir string, depth int) error {
+	switch strings.ToUpper(e.tokens[0].text) {
+	case "$ORIGIN":
+		if len(e.tokens) != 2 {
+			return errors.New("$ORIGIN takes a single domain name")
+		}
+		origin, err := p.absoluteName(e.tokens[1])
+		if err != nil {
+			return err
+		}
+		p.origin = origin
+		return nil
+	case "$TTL":
+		if len(e.tokens) != 2 {
+			return errors.New("$TTL takes a single TTL")
+		}
+		ttl, err := parseTTL(e.tokens[1].text)
+		if err != nil {
+			return err
+		}
+		p.ttl, p.hasTTL = ttl, true
+		return nil
+	case "$INCLUDE":
+		return p.include(e, dir, depth)
+	}
+	return p.parseRecord(e)
+}
+
+// include parses the file named by an $INCLUDE directive. As per RFC 1035 a
+// change of origin inside the included file does not carry over to the
+// including file.
+func (p *zoneParser) include(e entry, dir string, depth int) error {
+	if len(e.tokens) < 2 || len(e.tokens) > 3 {
+		return errors.New("$INCLUDE takes a file name and an optional origin")
+	}
+	if depth >= maxIncludeDepth {
+		return errors.New("$INCLUDE nested too deeply")
+	}
+	path := e.tokens[1].text
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	origin := p.origin
+	if len(e.tokens) == 3 {
+		o, err := p.absoluteName(e.tokens[2])
+		if err != nil {
+			return err
+		}
+		p.origin = o
+	}
+	err := p.parseFile(path, depth+1)
+	p.origin = origin
+	return err
+}
+
+func (p *zoneParser) parseRecord(e entry) error {
+	tokens := e.tokens
+	owner := p.lastOwner
+	if !e.blankOwner {
+		name, err := p.absoluteName(tokens[0])
+		if err != nil {
+			return err
+		}
+		owner = name
+		tokens = tokens[1:]
+	}
+	if owner == "" {
+		return errors.New("Record has no owner name")
+	}
+	p.lastOwner = owner
+
+	rr := parser.DNSResourceRecord{Name: owner, Class: p.lastClass, TTL: p.ttl}
+	hasTTL := p.hasTTL
+	if !hasTTL {
+		rr.TTL, hasTTL = p.lastTTL, p.hasLastTTL
+	}
+	for len(tokens) > 0 {
+		text := strings.ToUpper(tokens[0].text)
+		if rt, ok := recordTypes[text]; ok {
+			rr.Type = rt
+			tokens = tokens[1:]
+			break
+		}
+		if rc, ok := recordClasses[text]; ok {
+			rr.Class = rc
+		} else if ttl, err := parseTTL(tokens[0].text); err == nil {
+			rr.TTL, hasTTL = ttl, true
+			p.lastTTL, p.hasLastTTL = ttl, true
+		} else {
+			return fmt.Errorf("Unsupported record type %q", tokens[0].text)
+		}
+		tokens = tokens[1:]
+	}
+	if rr.Type == 0 {
+		return errors.New("Record has no type")
+	}
+	if rr.Class == 0 {
+		rr.Class = parser.RCIN
+	}
+	p.lastClass = rr.Class
+	rdata, err := p.parseRData(rr.Type, tokens)
+	if err != nil {
+		return fmt.Errorf("Invalid %v record: %w", rr.Type, err)
+	}
+	rr.RData = rdata
+	if !hasTTL {
+		// An SOA record without any TTL to inherit falls back to its
+		// MINIMUM field, as older zone files expect.
+		soa, ok := rdata.(parser.SOARecord)
+		if !ok {
+			return errors.New("Record has no TTL and no $TTL is set")
+		}
+		rr.TTL = soa.Minimum
+		p.lastTTL, p.hasLastTTL = rr.TTL, true
+	}
+	p.records = append(p.records, rr)
+	return nil
+}
+
+func (p *zoneParser) parseRData(rt parser.RecordType, tokens []token) (parser.RData, error) {
+	names := func(n int) ([]string, error) {
+		if len(tokens) != n {
+			return nil, fmt.Errorf("Expected %d fields, got %d", n, len(tokens))
+		}
+		res := make([]string, n)
+		for i, t := range tokens {
+			name, err := p.absoluteName(t)
+			if err != nil {
+				return nil, err
+			}
+			res[i] = name
+		}
+		return res, nil
+	}
+	switch rt {
+	case parser.RTA, parser.RTAAAA:
+		if len(tokens) != 1 {
+			return nil, errors.New("Expected a single address")
+		}
+		ip := net.ParseIP(tokens[0].text)
+		if ip == nil || (ip.To4() != nil) != (rt == parser.RTA) {
+			return nil, fmt.Errorf("Invalid address %q", tokens[0].text)
+		}
+		if rt == parser.RTA {
+			return parser.ARecord{IP: ip.To4()}, nil
+		}
+		return parser.AAAARecord{IP: ip}, nil
+	case parser.RTNS, parser.RTMD, parser.RTMF, parser.RTCNAME, parser.RTMB, parser.RTMG, parser.RTMR, parser.RTPTR:
+		n, err := names(1)
+		if err != nil {
+			return nil, err
+		}
+		switch rt {
+		case parser.RTNS:
+			return parser.NSRecord{Name: n[0]}, nil
+		case parser.RTMD:
+			return parser.MDRecord{Name: n[0]}, nil
+		case parser.RTMF:
+			return parser.MFRecord{Name: n[0]}, nil
+		case parser.RTCNAME:
+			return parser.CNameRecord{Name: n[0]}, nil
+		case parser.RTMB:
+			return parser.MBRecord{Name: n[0]}, nil
+		case parser.RTMG:
+			return parser.MGRecord{Name: n[0]}, nil
+		case parser.RTMR:
+			return parser.MRRecord{Name: n[0]}, nil
+		}
+		return parser.PTRRecord{Name: n[0]}, nil
+	case parser.RTMINFO:
+		n, err := names(2)
+		if err != nil {
+			return nil, err
+		}
+		return parser.MInfoRecord{RMailBX: n[0], EMailBX: n[1]}, nil
+	case parser.RTMX:
+		if len(tokens) != 2 {
+			return nil, errors.New("Expected a preference and an exchange")
+		}
+		pref, err := strconv.ParseUint(tokens[0].text, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid preference %q", tokens[0].text)
+		}
+		tokens = tokens[1:]
+		n, err := names(1)
+		if err != nil {
+			return nil, err
+		}
+		return parser.MXRecord{Preference: uint16(pref), Exchange: n[0]}, nil
+	case parser.RTSOA:
+		if len(tokens) != 7 {
+			return nil, fmt.Errorf("Expected 7 fields, got %d", len(tokens))
+		}
+		timers := tokens[2:]
+		tokens = tokens[:2]
+		n, err := names(2)
+		if err != nil {
+			return nil, err
+		}
+		values := make([]uint32, len(timers))
+		for i, t := range timers {
+			v, err := parseTTL(t.text)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = v
+		}
+		return parser.SOARecord{
+			MName:   n[0],
+			RName:   n[1],
+			Serial:  values[0],
+			Refresh: values[1],
+			Retry:   values[2],
+			Expire:  values[3],
+			Minimum: values[4],
+		}, nil
+	case parser.RTHINFO:
+		if len(tokens) != 2 {
+			return nil, errors.New("Expected a CPU and an OS")
+		}
+		return parser.HInfoRecord{CPU: tokens[0].text, OS: tokens[1].text}, nil
+	case parser.RTTXT:
+		if len(tokens) == 0 {
+			return nil, errors.New("Expected at least one string")
+		}
+		data := make([]string, len(tokens))
+		for i, t := range tokens {
+			if len(t.text) > 255 {
+				return nil, errors.New("String longer than 255 characters")
+			}
+			data[i] = t.text
+		}
+		return parser.TXTRecord{Data: data}, nil
+	}
+	return nil, errors.New("Unsupported record type")
+}
+
+// Parse reads a master file from r. Relative names are taken to be relative
+// to origin until a $ORIGIN directive changes it, and $INCLUDE paths are
+// relative to dir. When origin is empty the zone's origin is taken from its
+// SOA record.
+func Parse(r io.Reader, origin string, dir string) (*Zone, error) {
+	if origin != "" {
+		origin = canonicalName(origin)
+	}
+	p := zoneParser{origin: origin}
+	if err := p.parse(r, dir, 0); err != nil {
+		return nil, err
+	}
+	return New(origin, p.records)
+}
+
+// Load reads the master file at path, as Parse does.
+func Load(path string, origin string) (*Zone, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	z, err := Parse(f, origin, filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return z, nil
+}
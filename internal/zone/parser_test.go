@@ -0,0 +1,199 @@
+package zone
+
+import (
+	"dns/internal/parser"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testZone = `$ORIGIN example.com.
+$TTL 1h
+@	IN	SOA	ns1 hostmaster (
+		2024010101 ; serial
+		7200       ; refresh
+		3600       ; retry
+		1209600    ; expire
+		300 )      ; minimum
+	IN	NS	ns1
+	IN	NS	ns2.example.net.
+	IN	MX	10 mail
+ns1	IN	A	192.0.2.1
+mail	600	IN	A	192.0.2.25
+	IN	AAAA	2001:db8::25
+www	CNAME	@
+txt	IN	TXT	"hello world" "with \"quotes\""
+info	HINFO	"x86" Linux
+$ORIGIN sub.example.com.
+host	A	192.0.2.80
+`
+
+func findRecord(t *testing.T, z *Zone, name string, rt parser.RecordType) parser.DNSResourceRecord {
+	t.Helper()
+	rrs := z.names[canonicalName(name)][rt]
+	if len(rrs) == 0 {
+		t.Fatalf("expected %v record at %s", rt, name)
+	}
+	return rrs[0]
+}
+
+func TestParse(t *testing.T) {
+	z, err := Parse(strings.NewReader(testZone), "", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if z.Origin != "example.com." || z.Class != parser.RCIN {
+		t.Errorf("unexpected origin %s and class %v", z.Origin, z.Class)
+	}
+
+	soa := findRecord(t, z, "example.com.", parser.RTSOA).RData.(parser.SOARecord)
+	if soa.MName != "ns1.example.com." || soa.RName != "hostmaster.example.com." || soa.Serial != 2024010101 || soa.Minimum != 300 {
+		t.Errorf("unexpected SOA %v", soa)
+	}
+	if n := len(z.names["example.com."][parser.RTNS]); n != 2 {
+		t.Errorf("expected 2 NS records at the apex, got %d", n)
+	}
+	mx := findRecord(t, z, "example.com.", parser.RTMX)
+	if rd := mx.RData.(parser.MXRecord); rd.Preference != 10 || rd.Exchange != "mail.example.com." {
+		t.Errorf("unexpected MX %v", rd)
+	}
+	if rr := findRecord(t, z, "ns1.example.com.", parser.RTA); rr.TTL != 3600 {
+		t.Errorf("expected $TTL to apply, got %d", rr.TTL)
+	}
+	if rr := findRecord(t, z, "mail.example.com.", parser.RTA); rr.TTL != 600 {
+		t.Errorf("expected explicit TTL 600, got %d", rr.TTL)
+	}
+	if rr := findRecord(t, z, "mail.example.com.", parser.RTAAAA); rr.Name != "mail.example.com." {
+		t.Errorf("expected blank owner to repeat the previous one, got %s", rr.Name)
+	}
+	if rd := findRecord(t, z, "www.example.com.", parser.RTCNAME).RData.(parser.CNameRecord); rd.Name != "example.com." {
+		t.Errorf("expected @ to expand to the origin, got %s", rd.Name)
+	}
+	if rd := findRecord(t, z, "txt.example.com.", parser.RTTXT).RData.(parser.TXTRecord); len(rd.Data) != 2 || rd.Data[1] != `with "quotes"` {
+		t.Errorf("unexpected TXT %v", rd.Data)
+	}
+	if rd := findRecord(t, z, "info.example.com.", parser.RTHINFO).RData.(parser.HInfoRecord); rd.CPU != "x86" || rd.OS != "Linux" {
+		t.Errorf("unexpected HINFO %v", rd)
+	}
+	findRecord(t, z, "host.sub.example.com.", parser.RTA)
+}
+
+func TestParse_Errors(t *testing.T) {
+	soa := "@ 3600 IN SOA ns1 hostmaster 1 2 3 4 5\n"
+	tests := []struct {
+		name   string
+		zone   string
+		origin string
+	}{
+		{"relative name without origin", "www 3600 IN A 192.0.2.1\n", ""},
+		{"no SOA", "www 3600 IN A 192.0.2.1\n", "example.com."},
+		{"no TTL", "@ IN NS ns1\n" + soa, "example.com."},
+		{"unbalanced parentheses", soa + "www 3600 IN A ( 192.0.2.1\n", "example.com."},
+		{"invalid address", soa + "www A 192.0.2\n", "example.com."},
+		{"IPv6 in A record", soa + "www A 2001:db8::1\n", "example.com."},
+		{"unsupported type", soa + "www WKS 192.0.2.1 6 25\n", "example.com."},
+		{"out of zone", soa + "www.example.net. A 192.0.2.1\n", "example.com."},
+		{"CNAME and other data", soa + "www CNAME @\nwww A 192.0.2.1\n", "example.com."},
+		{"SOA not at origin", "www 3600 IN SOA ns1 hostmaster 1 2 3 4 5\n", "example.com."},
+		{"escaped dot in name", soa + "a\\.b A 192.0.2.1\n", "example.com."},
+		{"escape out of range", soa + "www TXT \"\\256\"\n", "example.com."},
+		{"short decimal escape", soa + "www TXT \"\\12\"\n", "example.com."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Parse(strings.NewReader(tt.zone), tt.origin, ""); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestTokenize_Escapes(t *testing.T) {
+	tests := []struct {
+		name             string
+		input            string
+		expectText       string
+		expectEscapedDot bool
+	}{
+		{"quoted character", `"say \"hi\""`, `say "hi"`, false},
+		{"quoted decimal", `"tab\009end"`, "tab\tend", false},
+		{"unquoted space", `two\ words`, "two words", false},
+		{"unquoted delimiter", `semi\;colon\(paren\)`, "semi;colon(paren)", false},
+		{"unquoted decimal", `caf\195\169`, "caf\u00e9", false},
+		{"escaped dot", `a\.b`, "a.b", true},
+		{"escaped dot in decimal", `a\046b`, "a.b", true},
+		{"quoted escaped dot", `"a\.b"`, "a.b", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := tokenize(strings.NewReader(tt.input + " next\n"))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(entries) != 1 || len(entries[0].tokens) != 2 {
+				t.Fatalf("expected 2 tokens, got %v", entries)
+			}
+			tok := entries[0].tokens[0]
+			if tok.text != tt.expectText || tok.escapedDot != tt.expectEscapedDot {
+				t.Errorf("expected %q with escaped dot %v, got %q with %v", tt.expectText, tt.expectEscapedDot, tok.text, tok.escapedDot)
+			}
+		})
+	}
+}
+
+func TestLoad_Include(t *testing.T) {
+	dir := t.TempDir()
+	main := "$TTL 300\n@ SOA ns1 hostmaster 1 2 3 4 5\n$INCLUDE hosts.inc hosts\nafter A 192.0.2.2\n"
+	hosts := "www A 192.0.2.1\n$ORIGIN elsewhere.example.com.\nother A 192.0.2.3\n"
+	if err := os.WriteFile(filepath.Join(dir, "example.com.zone"), []byte(main), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "hosts.inc"), []byte(hosts), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	z, err := Load(filepath.Join(dir, "example.com.zone"), "example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	findRecord(t, z, "www.hosts.example.com.", parser.RTA)
+	findRecord(t, z, "other.elsewhere.example.com.", parser.RTA)
+	findRecord(t, z, "after.example.com.", parser.RTA)
+}
+
+func TestLoad_IncludeLoop(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "loop.zone")
+	if err := os.WriteFile(path, []byte("$INCLUDE loop.zone\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path, "example.com."); err == nil {
+		t.Error("expected error for recursive $INCLUDE")
+	}
+}
+
+func TestParseTTL(t *testing.T) {
+	tests := []struct {
+		ttl     string
+		want    uint32
+		wantErr bool
+	}{
+		{"3600", 3600, false},
+		{"1h", 3600, false},
+		{"1h30m", 5400, false},
+		{"2W", 1209600, false},
+		{"1x", 0, true},
+		{"h", 0, true},
+		{"10m5", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseTTL(tt.ttl)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseTTL(%q) = %d, %v, expected %d", tt.ttl, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package zone
+
+import (
+	"dns/internal/parser"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// maxCNAMEChainLength bounds the aliases followed inside a zone.
+const maxCNAMEChainLength = 8
+
+func canonicalName(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
+
+func isSubdomain(name string, zone string) bool {
+	return zone == "." || name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+func getParent(name string) string {
+	if name == "." {
+		return ""
+	}
+	_, parent, _ := strings.Cut(name, ".")
+	if parent == "" {
+		return "."
+	}
+	return parent
+}
+
+type rrsets map[parser.RecordType][]parser.DNSResourceRecord
+
+// Zone holds the records of a zone we are authoritative for.
+type Zone struct {
+	Origin string
+	Class  parser.RecordClass
+	soa    parser.DNSResourceRecord
+	names  map[string]rrsets
+	// nodes holds every name in the zone, including empty non-terminals
+	// that own no records but have names below them.
+	nodes map[string]bool
+}
+
+// Answer is the outcome of looking up a name in a zone.
+type Answer struct {
+	RCode         parser.RCode
+	Authoritative bool
+	Answers       []parser.DNSResourceRecord
+	Authorities   []parser.DNSResourceRecord
+	Additionals   []parser.DNSResourceRecord
+}
+
+// New builds a zone from records, which must include exactly one SOA record
+// owned by the zone's origin. When origin is empty it is taken from the SOA.
+func New(origin string, records []parser.DNSResourceRecord) (*Zone, error) {
+	z := &Zone{names: make(map[string]rrsets), nodes: make(map[string]bool)}
+	for _, rr := range records {
+		if rr.Type != parser.RTSOA {
+			continue
+		}
+		if z.soa.Type != 0 {
+			return nil, errors.New("Zone has more than one SOA record")
+		}
+		z.soa = rr
+	}
+	if z.soa.Type == 0 {
+		return nil, errors.New("Zone has no SOA record")
+	}
+	z.Origin = canonicalName(z.soa.Name)
+	z.Class = z.soa.Class
+	if origin != "" && canonicalName(origin) != z.Origin {
+		return nil, fmt.Errorf("SOA record is owned by %s instead of the origin %s", z.soa.Name, origin)
+	}
+	for _, rr := range records {
+		name := canonicalName(rr.Name)
+		if !isSubdomain(name, z.Origin) {
+			return nil, fmt.Errorf("Record %s is outside the zone %s", rr.Name, z.Origin)
+		}
+		if rr.Class != z.Class {
+			return nil, fmt.Errorf("Record %s is not of class %v", rr.Name, z.Class)
+		}
+		if z.names[name] == nil {
+			z.names[name] = make(rrsets)
+		}
+		z.names[name][rr.Type] = append(z.names[name][rr.Type], rr)
+		for n := name; n != "" && !z.nodes[n]; n = getParent(n) {
+			z.nodes[n] = true
+			if n == z.Origin {
+				break
+			}
+		}
+	}
+	for name, sets := range z.names {
+		if _, ok := sets[parser.RTCNAME]; ok && len(sets) > 1 {
+			return nil, fmt.Errorf("CNAME at %s alongside other data", name)
+		}
+	}
+	return z, nil
+}
+
+// Contains reports whether name lies within the zone.
+func (z *Zone) Contains(name string) bool {
+	return isSubdomain(canonicalName(name), z.Origin)
+}
+
+// getNegativeSOA returns the SOA record to put in the authority section of a
+// negative answer, with its TTL lowered to the MINIMUM field (RFC 2308).
+func (z *Zone) getNegativeSOA() parser.DNSResourceRecord {
+	soa := z.soa
+	if rd, ok := soa.RData.(parser.SOARecord); ok {
+		soa.TTL = min(soa.TTL, rd.Minimum)
+	}
+	return soa
+}
+
+// getDelegation returns the NS records of the highest zone cut between the
+// origin and name, if name has been delegated away from this zone.
+func (z *Zone) getDelegation(name string) ([]parser.DNSResourceRecord, bool) {
+	ancestors := make([]string, 0)
+	for n := name; n != z.Origin && n != ""; n = getParent(n) {
+		ancestors = append(ancestors, n)
+	}
+	for i := len(ancestors) - 1; i >= 0; i-- {
+		if ns, ok := z.names[ancestors[i]][parser.RTNS]; ok {
+			return ns, true
+		}
+	}
+	return nil, false
+}
+
+// getWildcard returns the records of the wildcard that name is synthesized
+// from as described in RFC 4592, taken from the closest existing ancestor.
+func (z *Zone) getWildcard(name string) (rrsets, bool) {
+	for n := getParent(name); n != "" && isSubdomain(n, z.Origin); n = getParent(n) {
+		if !z.nodes[n] {
+			continue
+		}
+		sets, ok := z.names["*."+n]
+		return sets, ok
+	}
+	return nil, false
+}
+
+func synthesize(rrs []parser.DNSResourceRecord, name string) []parser.DNSResourceRecord {
+	res := make([]parser.DNSResourceRecord, len(rrs))
+	for i, rr := range rrs {
+		rr.Name = name
+		res[i] = rr
+	}
+	return res
+}
+
+// getAddresses returns the in-zone addresses for the targets of NS and MX
+// records in rrs, to be put in the additional section.
+func (z *Zone) getAddresses(rrs []parser.DNSResourceRecord) []parser.DNSResourceRecord {
+	res := make([]parser.DNSResourceRecord, 0)
+	for _, rr := range rrs {
+		var target string
+		switch rd := rr.RData.(type) {
+		case parser.NSRecord:
+			target = rd.Name
+		case parser.MXRecord:
+			target = rd.Exchange
+		default:
+			continue
+		}
+		sets := z.names[canonicalName(target)]
+		res = append(res, sets[parser.RTA]...)
+		res = append(res, sets[parser.RTAAAA]...)
+	}
+	return res
+}
+
+// Lookup answers a query for name and qtype from the zone, following the
+// algorithm of RFC 1034 section 4.3.2. Names below a zone cut get a referral,
+// aliases are followed while they stay inside the zone, and names that do
+// not exist are matched against wildcards before NXDOMAIN is returned.
+func (z *Zone) Lookup(name string, qtype parser.RecordType) Answer {
+	a := Answer{Authoritative: true}
+	owner := name
+	name = canonicalName(name)
+	visited := map[string]bool{name: true}
+	for range maxCNAMEChainLength {
+		if ns, ok := z.getDelegation(name); ok {
+			if len(a.Answers) == 0 {
+				a.Authoritative = false
+				a.Authorities = ns
+				a.Additionals = z.getAddresses(ns)
+			}
+			return a
+		}
+		sets, ok := z.names[name]
+		if !ok && !z.nodes[name] {
+			if sets, ok = z.getWildcard(name); ok {
+				synthesized := make(rrsets, len(sets))
+				for rt, rrs := range sets {
+					synthesized[rt] = synthesize(rrs, owner)
+				}
+				sets = synthesized
+			}
+		}
+		if !ok && !z.nodes[name] {
+			a.RCode = parser.NXDomain
+			a.Authorities = []parser.DNSResourceRecord{z.getNegativeSOA()}
+			return a
+		}
+		if qtype == parser.RTSTAR && len(sets) > 0 {
+			for _, rrs := range sets {
+				a.Answers = append(a.Answers, rrs...)
+			}
+			return a
+		}
+		if rrs, ok := sets[qtype]; ok {
+			a.Answers = append(a.Answers, rrs...)
+			if qtype == parser.RTNS || qtype == parser.RTMX {
+				a.Additionals = z.getAddresses(rrs)
+			}
+			return a
+		}
+		cname, ok := sets[parser.RTCNAME]
+		if !ok {
+			a.Authorities = []parser.DNSResourceRecord{z.getNegativeSOA()}
+			return a
+		}
+		a.Answers = append(a.Answers, cname...)
+		owner = cname[0].RData.(parser.CNameRecord).Name
+		name = canonicalName(owner)
+		if visited[name] || !isSubdomain(name, z.Origin) {
+			return a
+		}
+		visited[name] = true
+	}
+	return a
+}
@@ -0,0 +1,114 @@
+package zone
+
+import (
+	"dns/internal/parser"
+	"strings"
+	"testing"
+)
+
+const lookupZone = `$ORIGIN example.com.
+$TTL 3600
+@		SOA	ns1 hostmaster 1 7200 3600 1209600 300
+		NS	ns1
+		MX	10 mail
+ns1		A	192.0.2.1
+mail		A	192.0.2.25
+www		CNAME	web
+web		A	192.0.2.80
+alias		CNAME	www.example.net.
+broken		CNAME	missing
+loop1		CNAME	loop2
+loop2		CNAME	loop1
+*.apps		A	192.0.2.100
+host.empty	A	192.0.2.5
+child		NS	ns.child
+ns.child	A	192.0.2.53
+`
+
+func TestLookup(t *testing.T) {
+	z, err := Parse(strings.NewReader(lookupZone), "", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name              string
+		qname             string
+		qtype             parser.RecordType
+		expectRCode       parser.RCode
+		expectAA          bool
+		expectAnswers     []parser.RecordType
+		expectAuthorities []parser.RecordType
+		expectAdditionals int
+	}{
+		{"exact match", "web.example.com.", parser.RTA, parser.NoError, true, []parser.RecordType{parser.RTA}, nil, 0},
+		{"case insensitive", "WEB.Example.COM.", parser.RTA, parser.NoError, true, []parser.RecordType{parser.RTA}, nil, 0},
+		{"apex NS with glue", "example.com.", parser.RTNS, parser.NoError, true, []parser.RecordType{parser.RTNS}, nil, 1},
+		{"MX with address", "example.com.", parser.RTMX, parser.NoError, true, []parser.RecordType{parser.RTMX}, nil, 1},
+		{"CNAME followed in zone", "www.example.com.", parser.RTA, parser.NoError, true, []parser.RecordType{parser.RTCNAME, parser.RTA}, nil, 0},
+		{"CNAME queried directly", "www.example.com.", parser.RTCNAME, parser.NoError, true, []parser.RecordType{parser.RTCNAME}, nil, 0},
+		{"CNAME leaving zone", "alias.example.com.", parser.RTA, parser.NoError, true, []parser.RecordType{parser.RTCNAME}, nil, 0},
+		{"CNAME to missing name", "broken.example.com.", parser.RTA, parser.NXDomain, true, []parser.RecordType{parser.RTCNAME}, []parser.RecordType{parser.RTSOA}, 0},
+		{"CNAME loop", "loop1.example.com.", parser.RTA, parser.NoError, true, []parser.RecordType{parser.RTCNAME, parser.RTCNAME}, nil, 0},
+		{"NODATA", "web.example.com.", parser.RTAAAA, parser.NoError, true, nil, []parser.RecordType{parser.RTSOA}, 0},
+		{"empty non-terminal", "empty.example.com.", parser.RTA, parser.NoError, true, nil, []parser.RecordType{parser.RTSOA}, 0},
+		{"NXDOMAIN", "missing.example.com.", parser.RTA, parser.NXDomain, true, nil, []parser.RecordType{parser.RTSOA}, 0},
+		{"wildcard", "api.apps.example.com.", parser.RTA, parser.NoError, true, []parser.RecordType{parser.RTA}, nil, 0},
+		{"wildcard NODATA", "api.apps.example.com.", parser.RTMX, parser.NoError, true, nil, []parser.RecordType{parser.RTSOA}, 0},
+		{"wildcard below existing name", "x.host.empty.example.com.", parser.RTA, parser.NXDomain, true, nil, []parser.RecordType{parser.RTSOA}, 0},
+		{"referral", "www.child.example.com.", parser.RTA, parser.NoError, false, nil, []parser.RecordType{parser.RTNS}, 1},
+		{"referral at cut", "child.example.com.", parser.RTNS, parser.NoError, false, nil, []parser.RecordType{parser.RTNS}, 1},
+		{"any", "mail.example.com.", parser.RTSTAR, parser.NoError, true, []parser.RecordType{parser.RTA}, nil, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := z.Lookup(tt.qname, tt.qtype)
+			if a.RCode != tt.expectRCode {
+				t.Errorf("expected RCODE %v, got %v", tt.expectRCode, a.RCode)
+			}
+			if a.Authoritative != tt.expectAA {
+				t.Errorf("expected AA %v, got %v", tt.expectAA, a.Authoritative)
+			}
+			checkTypes(t, "answers", a.Answers, tt.expectAnswers)
+			checkTypes(t, "authorities", a.Authorities, tt.expectAuthorities)
+			if len(a.Additionals) != tt.expectAdditionals {
+				t.Errorf("expected %d additionals, got %v", tt.expectAdditionals, a.Additionals)
+			}
+		})
+	}
+}
+
+func checkTypes(t *testing.T, section string, rrs []parser.DNSResourceRecord, expect []parser.RecordType) {
+	t.Helper()
+	if len(rrs) != len(expect) {
+		t.Fatalf("expected %d %s, got %v", len(expect), section, rrs)
+	}
+	for i, rr := range rrs {
+		if rr.Type != expect[i] {
+			t.Errorf("expected %s[%d] to be %v, got %v", section, i, expect[i], rr.Type)
+		}
+	}
+}
+
+func TestLookup_WildcardOwner(t *testing.T) {
+	z, err := Parse(strings.NewReader(lookupZone), "", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	a := z.Lookup("api.apps.example.com.", parser.RTA)
+	if a.Answers[0].Name != "api.apps.example.com." {
+		t.Errorf("expected synthesized record to be owned by the query name, got %s", a.Answers[0].Name)
+	}
+}
+
+func TestLookup_NegativeSOATTL(t *testing.T) {
+	z, err := Parse(strings.NewReader(lookupZone), "", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	a := z.Lookup("missing.example.com.", parser.RTA)
+	if a.Authorities[0].TTL != 300 {
+		t.Errorf("expected SOA TTL lowered to MINIMUM, got %d", a.Authorities[0].TTL)
+	}
+}